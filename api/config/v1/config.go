@@ -35,6 +35,7 @@ type Config struct {
 	Flags     Flags     `json:"flags,omitempty"     yaml:"flags,omitempty"`
 	Resources Resources `json:"resources,omitempty" yaml:"resources,omitempty"`
 	Sharing   Sharing   `json:"sharing,omitempty"   yaml:"sharing,omitempty"`
+	Health    Health    `json:"health,omitempty"    yaml:"health,omitempty"`
 }
 
 // NewConfig builds out a Config struct from a config file (or command line flags).
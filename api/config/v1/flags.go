@@ -55,9 +55,12 @@ type CommandLineFlags struct {
 
 // PluginCommandLineFlags holds the list of command line flags specific to the device plugin.
 type PluginCommandLineFlags struct {
-	PassDeviceSpecs    *bool   `json:"passDeviceSpecs"    yaml:"passDeviceSpecs"`
-	DeviceListStrategy *string `json:"deviceListStrategy" yaml:"deviceListStrategy"`
-	DeviceIDStrategy   *string `json:"deviceIDStrategy"   yaml:"deviceIDStrategy"`
+	PassDeviceSpecs     *bool   `json:"passDeviceSpecs"               yaml:"passDeviceSpecs"`
+	DeviceListStrategy  *string `json:"deviceListStrategy"            yaml:"deviceListStrategy"`
+	DeviceIDStrategy    *string `json:"deviceIDStrategy"              yaml:"deviceIDStrategy"`
+	SharingNodeLabels   *bool   `json:"sharingNodeLabels"             yaml:"sharingNodeLabels"`
+	ContainerDriverRoot *string `json:"containerDriverRoot,omitempty" yaml:"containerDriverRoot,omitempty"`
+	NvidiaCTKPath       *string `json:"nvidiaCTKPath,omitempty"       yaml:"nvidiaCTKPath,omitempty"`
 }
 
 // GFDCommandLineFlags holds the list of command line flags specific to GFD.
@@ -92,6 +95,12 @@ func (f *Flags) UpdateFromCLIFlags(c *cli.Context, flags []cli.Flag) {
 				updateFromCLIFlag(&f.Plugin.DeviceListStrategy, c, n)
 			case "device-id-strategy":
 				updateFromCLIFlag(&f.Plugin.DeviceIDStrategy, c, n)
+			case "sharing-node-labels":
+				updateFromCLIFlag(&f.Plugin.SharingNodeLabels, c, n)
+			case "container-driver-root":
+				updateFromCLIFlag(&f.Plugin.ContainerDriverRoot, c, n)
+			case "nvidia-ctk-path":
+				updateFromCLIFlag(&f.Plugin.NvidiaCTKPath, c, n)
 			}
 			// GFD specific flags
 			if f.GFD == nil {
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Constants related to resources advertised in fractions of a GPU
+const (
+	FractionsPerGPU                     = 100
+	DefaultFractionalResourceNameSuffix = "-fraction"
+)
+
+// Fractional defines the set of resources to be advertised in fractions of a GPU.
+// Each device is advertised as FractionsPerGPU units, and all units allocated to a container come from the same device.
+// Fractions are shared through the CUDA Multi-Process Service, limiting each container to a share of the device's
+// threads proportional to the number of units it requests.
+type Fractional struct {
+	Resources []FractionalResource `json:"resources,omitempty" yaml:"resources,omitempty"`
+}
+
+// FractionalResource represents a resource to be advertised in fractions.
+type FractionalResource struct {
+	Name    ResourceName      `json:"name"             yaml:"name"`
+	Rename  ResourceName      `json:"rename,omitempty" yaml:"rename,omitempty"`
+	Devices ReplicatedDevices `json:"devices"          yaml:"devices,flow"`
+}
+
+// DefaultFractionalRename returns the default renaming to apply when this resource is advertised in fractions
+func (r ResourceName) DefaultFractionalRename() ResourceName {
+	return r + DefaultFractionalResourceNameSuffix
+}
+
+// ReplicatedResource returns the fractional resource as a resource with one replica per fraction of a device.
+func (r *FractionalResource) ReplicatedResource() ReplicatedResource {
+	return ReplicatedResource{
+		Name:     r.Name,
+		Rename:   r.Rename,
+		Devices:  r.Devices,
+		Replicas: FractionsPerGPU,
+	}
+}
+
+// UnmarshalJSON unmarshals raw bytes into a 'Fractional' struct.
+func (s *Fractional) UnmarshalJSON(b []byte) error {
+	f := make(map[string]json.RawMessage)
+	err := json.Unmarshal(b, &f)
+	if err != nil {
+		return err
+	}
+
+	resources, exists := f["resources"]
+	if !exists {
+		return fmt.Errorf("no resources specified")
+	}
+
+	err = json.Unmarshal(resources, &s.Resources)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Resources) == 0 {
+		return fmt.Errorf("no resources specified")
+	}
+
+	return nil
+}
+
+// UnmarshalJSON unmarshals raw bytes into a 'FractionalResource' struct.
+func (s *FractionalResource) UnmarshalJSON(b []byte) error {
+	fr := make(map[string]json.RawMessage)
+	err := json.Unmarshal(b, &fr)
+	if err != nil {
+		return err
+	}
+
+	name, exists := fr["name"]
+	if !exists {
+		return fmt.Errorf("no resource name specified")
+	}
+
+	err = json.Unmarshal(name, &s.Name)
+	if err != nil {
+		return err
+	}
+
+	devices, exists := fr["devices"]
+	if !exists {
+		devices = []byte(`"all"`)
+	}
+
+	err = json.Unmarshal(devices, &s.Devices)
+	if err != nil {
+		return err
+	}
+
+	rename, exists := fr["rename"]
+	if !exists {
+		s.Rename = s.Name.DefaultFractionalRename()
+		return nil
+	}
+
+	err = json.Unmarshal(rename, &s.Rename)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalFractional(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output Fractional
+		err    bool
+	}{
+		{
+			input: `{}`,
+			err:   true,
+		},
+		{
+			input: `{
+				"resources": []
+			}`,
+			err: true,
+		},
+		{
+			input: `{
+				"resources": [
+					{
+						"name": "gpu"
+					}
+				]
+			}`,
+			output: Fractional{
+				Resources: []FractionalResource{
+					{
+						Name:    NoErrorNewResourceName("gpu"),
+						Rename:  NoErrorNewResourceName("gpu-fraction"),
+						Devices: ReplicatedDevices{All: true},
+					},
+				},
+			},
+		},
+		{
+			input: `{
+				"resources": [
+					{
+						"name": "gpu",
+						"rename": "gpu-slice",
+						"devices": 2
+					}
+				]
+			}`,
+			output: Fractional{
+				Resources: []FractionalResource{
+					{
+						Name:    NoErrorNewResourceName("gpu"),
+						Rename:  NoErrorNewResourceName("gpu-slice"),
+						Devices: ReplicatedDevices{Count: 2},
+					},
+				},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			var output Fractional
+			err := output.UnmarshalJSON([]byte(tc.input))
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.output, output)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+// UnhealthyNodeLabel is the label applied to a node once too many of its devices are unhealthy.
+const UnhealthyNodeLabel = ResourceNamePrefix + "/gpu.unhealthy"
+
+// FailedDevicesAnnotation is the annotation listing the failed devices of a pod when OnDeviceFailure is 'annotate'.
+const FailedDevicesAnnotation = ResourceNamePrefix + "/gpu.failed-devices"
+
+// Constants representing the actions taken on pods using a device that fails or is removed
+const (
+	OnDeviceFailureIgnore   = "ignore"
+	OnDeviceFailureAnnotate = "annotate"
+	OnDeviceFailureEvict    = "evict"
+)
+
+// Health defines the policy used to mark devices unhealthy and to recover them again.
+//
+// If Xids is empty, all critical Xid errors except well-known application errors mark a device unhealthy.
+// If RecoveryCooldown is set, unhealthy devices are probed again once it has passed and marked healthy if they respond.
+// If UnhealthyNodeThreshold is set, the node is labeled with UnhealthyNodeLabel while more than that many devices are unhealthy.
+// OnDeviceFailure selects what happens to pods using a device that becomes unhealthy or is no longer advertised
+// (one of OnDeviceFailureIgnore, OnDeviceFailureAnnotate, or OnDeviceFailureEvict; empty means OnDeviceFailureIgnore).
+type Health struct {
+	Xids                   []uint64  `json:"xids,omitempty"                   yaml:"xids,omitempty"`
+	RecoveryCooldown       *Duration `json:"recoveryCooldown,omitempty"       yaml:"recoveryCooldown,omitempty"`
+	UnhealthyNodeThreshold *int      `json:"unhealthyNodeThreshold,omitempty" yaml:"unhealthyNodeThreshold,omitempty"`
+	OnDeviceFailure        string    `json:"onDeviceFailure,omitempty"        yaml:"onDeviceFailure,omitempty"`
+}
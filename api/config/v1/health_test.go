@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestUnmarshalHealth(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output Health
+		err    bool
+	}{
+		{
+			input:  `{}`,
+			output: Health{},
+		},
+		{
+			input: `
+xids: [48, 79]
+recoveryCooldown: 5m
+unhealthyNodeThreshold: 2
+onDeviceFailure: evict
+`,
+			output: Health{
+				Xids:                   []uint64{48, 79},
+				RecoveryCooldown:       ptr(Duration(5 * time.Minute)),
+				UnhealthyNodeThreshold: ptr(2),
+				OnDeviceFailure:        OnDeviceFailureEvict,
+			},
+		},
+		{
+			input: `
+recoveryCooldown: not-a-duration
+`,
+			err: true,
+		},
+		{
+			input: `
+xids: [-1]
+`,
+			err: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			var output Health
+			err := yaml.Unmarshal([]byte(tc.input), &output)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.output, output)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MaxMPSReplicas is the maximum number of replicas a device can be shared as through MPS.
+// Each replica is limited to an integral percentage of the threads on its device.
+const MaxMPSReplicas = 100
+
+// MPS defines the set of replicas to be shared through the CUDA Multi-Process Service.
+type MPS struct {
+	RenameByDefault bool                 `json:"renameByDefault,omitempty" yaml:"renameByDefault,omitempty"`
+	Resources       []ReplicatedResource `json:"resources,omitempty"       yaml:"resources,omitempty"`
+}
+
+// ActiveThreadPercentage returns the share of a device's threads each of its replicas is limited to.
+func (r *ReplicatedResource) ActiveThreadPercentage() int {
+	return 100 / r.Replicas
+}
+
+// UnmarshalJSON unmarshals raw bytes into an 'MPS' struct.
+func (s *MPS) UnmarshalJSON(b []byte) error {
+	mps := make(map[string]json.RawMessage)
+	err := json.Unmarshal(b, &mps)
+	if err != nil {
+		return err
+	}
+
+	renameByDefault, exists := mps["renameByDefault"]
+	if !exists {
+		renameByDefault = []byte(`false`)
+	}
+
+	err = json.Unmarshal(renameByDefault, &s.RenameByDefault)
+	if err != nil {
+		return err
+	}
+
+	resources, exists := mps["resources"]
+	if !exists {
+		return fmt.Errorf("no resources specified")
+	}
+
+	err = json.Unmarshal(resources, &s.Resources)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Resources) == 0 {
+		return fmt.Errorf("no resources specified")
+	}
+
+	for i, r := range s.Resources {
+		if r.Replicas > MaxMPSReplicas {
+			return fmt.Errorf("number of MPS replicas for %v must be at most %d", r.Name, MaxMPSReplicas)
+		}
+		if s.RenameByDefault && r.Rename == "" {
+			s.Resources[i].Rename = r.Name.DefaultSharedRename()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalMPS(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output MPS
+		err    bool
+	}{
+		{
+			input: `{}`,
+			err:   true,
+		},
+		{
+			input: `{
+				"resources": []
+			}`,
+			err: true,
+		},
+		{
+			input: `{
+				"resources": [
+					{
+						"name": "valid",
+						"replicas": 4
+					}
+				]
+			}`,
+			output: MPS{
+				Resources: []ReplicatedResource{
+					{
+						Name:     NoErrorNewResourceName("valid"),
+						Devices:  ReplicatedDevices{All: true},
+						Replicas: 4,
+					},
+				},
+			},
+		},
+		{
+			input: `{
+				"resources": [
+					{
+						"name": "valid",
+						"replicas": 100
+					}
+				]
+			}`,
+			output: MPS{
+				Resources: []ReplicatedResource{
+					{
+						Name:     NoErrorNewResourceName("valid"),
+						Devices:  ReplicatedDevices{All: true},
+						Replicas: 100,
+					},
+				},
+			},
+		},
+		{
+			input: `{
+				"resources": [
+					{
+						"name": "valid",
+						"replicas": 101
+					}
+				]
+			}`,
+			err: true,
+		},
+		{
+			input: `{
+				"renameByDefault": true,
+				"resources": [
+					{
+						"name": "valid",
+						"replicas": 4
+					}
+				]
+			}`,
+			output: MPS{
+				RenameByDefault: true,
+				Resources: []ReplicatedResource{
+					{
+						Name:     NoErrorNewResourceName("valid"),
+						Rename:   NoErrorNewResourceName("valid.shared"),
+						Devices:  ReplicatedDevices{All: true},
+						Replicas: 4,
+					},
+				},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			var output MPS
+			err := output.UnmarshalJSON([]byte(tc.input))
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.output, output)
+		})
+	}
+}
+
+func TestActiveThreadPercentage(t *testing.T) {
+	testCases := []struct {
+		replicas int
+		expected int
+	}{
+		{replicas: 2, expected: 50},
+		{replicas: 3, expected: 33},
+		{replicas: 10, expected: 10},
+		{replicas: 100, expected: 1},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			r := ReplicatedResource{Replicas: tc.replicas}
+			require.Equal(t, tc.expected, r.ActiveThreadPercentage())
+		})
+	}
+}
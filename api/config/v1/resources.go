@@ -28,6 +28,12 @@ import (
 // ResourcePattern is used to match a resource name to a specific pattern
 type ResourcePattern string
 
+// Prefixes of a ResourcePattern selecting the GPU property it is matched against
+const (
+	UUIDPatternPrefix  = "uuid:"
+	BusIDPatternPrefix = "busid:"
+)
+
 // ResourceName represents a valid resource name in Kubernetes
 type ResourceName string
 
@@ -165,6 +171,34 @@ func (p ResourcePattern) Matches(s string) bool {
 	return result
 }
 
+// MatchesGPU checks if a GPU with the given product name, UUID and PCI bus ID matches the ResourcePattern or not.
+// Patterns prefixed with 'uuid:' or 'busid:' must match the whole UUID or PCI bus ID. PCI bus IDs are compared
+// ignoring case and the width of their domain, so both the NVML (e.g. '00000000:00:1E.0') and the sysfs
+// (e.g. '0000:00:1e.0') formats can be used. All other patterns are matched against the product name, as with Matches.
+func (p ResourcePattern) MatchesGPU(name, uuid, busID string) bool {
+	switch {
+	case strings.HasPrefix(string(p), UUIDPatternPrefix):
+		pattern := strings.TrimPrefix(string(p), UUIDPatternPrefix)
+		result, _ := regexp.MatchString("^"+wildCardToRegexp(pattern)+"$", uuid)
+		return result
+	case strings.HasPrefix(string(p), BusIDPatternPrefix):
+		pattern := normalizeBusID(strings.TrimPrefix(string(p), BusIDPatternPrefix))
+		result, _ := regexp.MatchString("^"+wildCardToRegexp(pattern)+"$", normalizeBusID(busID))
+		return result
+	}
+	return p.Matches(name)
+}
+
+// normalizeBusID converts a PCI bus ID to the format used in sysfs, with a lower case, 4 digit domain.
+func normalizeBusID(busID string) string {
+	busID = strings.ToLower(busID)
+	parts := strings.SplitN(busID, ":", 2)
+	if len(parts) == 2 && len(parts[0]) == 8 && strings.HasPrefix(parts[0], "0000") {
+		return parts[0][4:] + ":" + parts[1]
+	}
+	return busID
+}
+
 // wildCardToRegexp converts a wildcard pattern to a regular expression pattern.
 func wildCardToRegexp(pattern string) string {
 	var result strings.Builder
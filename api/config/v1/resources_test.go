@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchesGPU(t *testing.T) {
+	const (
+		name = "Tesla T4"
+		uuid = "GPU-8dcd427f-483b-b48f-d7e5-75fb19a52b10"
+		// PCI bus IDs are passed in the format used in sysfs.
+		busID = "0000:00:1e.0"
+	)
+
+	testCases := []struct {
+		pattern  ResourcePattern
+		expected bool
+	}{
+		{pattern: "*T4*", expected: true},
+		{pattern: "Tesla T4", expected: true},
+		{pattern: "*A100*", expected: false},
+		// Plain patterns are only matched against the product name.
+		{pattern: "*10*", expected: false},
+		{pattern: "*1E*", expected: false},
+		{pattern: "uuid:" + uuid, expected: true},
+		{pattern: "uuid:GPU-8dcd427f-*", expected: true},
+		{pattern: "uuid:*10", expected: true},
+		// UUID and bus ID patterns must match the whole value.
+		{pattern: "uuid:8dcd427f", expected: false},
+		{pattern: "uuid:Tesla T4", expected: false},
+		{pattern: "busid:" + busID, expected: true},
+		{pattern: "busid:00000000:00:1E.0", expected: true},
+		{pattern: "busid:00000000:00:1e.0", expected: true},
+		{pattern: "busid:0000:00:1E.0", expected: true},
+		{pattern: "busid:00000000:00:*", expected: true},
+		{pattern: "busid:00000000:01:*", expected: false},
+		{pattern: "busid:00:1E.0", expected: false},
+		{pattern: "busid:00000000:00:1E", expected: false},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.pattern), func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.pattern.MatchesGPU(name, uuid, busID))
+		})
+	}
+}
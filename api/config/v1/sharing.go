@@ -16,7 +16,75 @@
 
 package v1
 
+import "fmt"
+
 // Sharing encapsulates the set of sharing strategies that are supported.
 type Sharing struct {
 	TimeSlicing TimeSlicing `json:"timeSlicing,omitempty" yaml:"timeSlicing,omitempty"`
+	MPS         *MPS        `json:"mps,omitempty"         yaml:"mps,omitempty"`
+	Fractional  *Fractional `json:"fractional,omitempty"  yaml:"fractional,omitempty"`
+}
+
+// MPSResources returns the set of resources to be shared through MPS (if any).
+func (s *Sharing) MPSResources() []ReplicatedResource {
+	if s.MPS == nil {
+		return nil
+	}
+	return s.MPS.Resources
+}
+
+// FractionalResources returns the set of resources to be advertised in fractions (if any),
+// each replicated once per fraction of a device.
+func (s *Sharing) FractionalResources() []ReplicatedResource {
+	if s.Fractional == nil {
+		return nil
+	}
+	var resources []ReplicatedResource
+	for _, r := range s.Fractional.Resources {
+		resources = append(resources, r.ReplicatedResource())
+	}
+	return resources
+}
+
+// ValidateRenames checks that no two shared resources end up being advertised under the same name.
+// The replicas of an entry replace any devices already advertised under its rename target, so a rename target
+// may neither repeat the name or rename of another entry nor be the name of one of 'resources' that is not shared.
+func (s *Sharing) ValidateRenames(resources Resources) error {
+	var shared []ReplicatedResource
+	shared = append(shared, s.TimeSlicing.Resources...)
+	shared = append(shared, s.MPSResources()...)
+	shared = append(shared, s.FractionalResources()...)
+
+	names := make(map[ResourceName]bool)
+	for _, r := range shared {
+		if names[r.Name] {
+			return fmt.Errorf("resource '%v' is listed more than once across all sharing strategies", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	renames := make(map[ResourceName]ResourceName)
+	for _, r := range shared {
+		if r.Rename == "" || r.Rename == r.Name {
+			continue
+		}
+		if names[r.Rename] {
+			return fmt.Errorf("resource '%v' cannot be renamed to '%v' as another entry shares a resource of that name", r.Name, r.Rename)
+		}
+		if other, exists := renames[r.Rename]; exists {
+			return fmt.Errorf("resources '%v' and '%v' cannot both be renamed to '%v'", other, r.Name, r.Rename)
+		}
+		renames[r.Rename] = r.Name
+	}
+
+	var configured []Resource
+	configured = append(configured, resources.GPUs...)
+	configured = append(configured, resources.MIGs...)
+	for _, r := range configured {
+		if other, exists := renames[r.Name]; exists {
+			return fmt.Errorf("resource '%v' cannot be renamed to '%v' as that resource is not shared", other, r.Name)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRenames(t *testing.T) {
+	gpu := NoErrorNewResourceName("gpu")
+	t4 := NoErrorNewResourceName("t4")
+	a100 := NoErrorNewResourceName("a100")
+	shared := NoErrorNewResourceName("shared")
+
+	resources := Resources{
+		GPUs: []Resource{
+			{Pattern: "*T4*", Name: t4},
+			{Pattern: "*A100*", Name: a100},
+			{Pattern: "*", Name: gpu},
+		},
+	}
+
+	testCases := []struct {
+		description string
+		sharing     Sharing
+		err         bool
+	}{
+		{
+			description: "no sharing",
+		},
+		{
+			description: "distinct renames",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Rename: shared, Replicas: 8},
+						{Name: a100, Rename: a100.DefaultSharedRename(), Replicas: 2},
+					},
+				},
+			},
+		},
+		{
+			description: "rename to the shared resource itself",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Rename: t4, Replicas: 8},
+					},
+				},
+			},
+		},
+		{
+			description: "repeated name",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Replicas: 8},
+						{Name: t4, Rename: shared, Replicas: 2},
+					},
+				},
+			},
+			err: true,
+		},
+		{
+			description: "repeated name across strategies",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Replicas: 8},
+					},
+				},
+				MPS: &MPS{
+					Resources: []ReplicatedResource{
+						{Name: t4, Replicas: 2},
+					},
+				},
+			},
+			err: true,
+		},
+		{
+			description: "repeated rename",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Rename: shared, Replicas: 8},
+						{Name: a100, Rename: shared, Replicas: 2},
+					},
+				},
+			},
+			err: true,
+		},
+		{
+			description: "repeated rename across strategies",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Rename: shared, Replicas: 8},
+					},
+				},
+				Fractional: &Fractional{
+					Resources: []FractionalResource{
+						{Name: a100, Rename: shared},
+					},
+				},
+			},
+			err: true,
+		},
+		{
+			description: "rename to the name of another entry",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Rename: a100, Replicas: 8},
+						{Name: a100, Rename: shared, Replicas: 2},
+					},
+				},
+			},
+			err: true,
+		},
+		{
+			description: "rename to a resource that is not shared",
+			sharing: Sharing{
+				TimeSlicing: TimeSlicing{
+					Resources: []ReplicatedResource{
+						{Name: t4, Rename: gpu, Replicas: 8},
+					},
+				},
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := tc.sharing.ValidateRenames(resources)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
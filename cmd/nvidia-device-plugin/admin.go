@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// adminServer serves administrative requests for the plugin (e.g. reloading its config) over a Unix socket.
+type adminServer struct {
+	socket  string
+	server  *http.Server
+	reloads chan chan error
+}
+
+// newAdminServer starts serving admin requests on the given Unix socket.
+func newAdminServer(socket string) (*adminServer, error) {
+	err := os.MkdirAll(filepath.Dir(socket), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory for admin socket: %v", err)
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on admin socket: %v", err)
+	}
+
+	s := &adminServer{
+		socket:  socket,
+		reloads: make(chan chan error),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", s.handleReload)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin server on %s stopped: %v", socket, err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Reloads returns the channel on which reload requests are delivered.
+// The result of each reload must be sent back on the channel received.
+// A nil adminServer returns a nil channel, which never delivers any requests.
+func (s *adminServer) Reloads() <-chan chan error {
+	if s == nil {
+		return nil
+	}
+	return s.reloads
+}
+
+// Close stops the admin server and removes its socket.
+func (s *adminServer) Close() error {
+	if s == nil {
+		return nil
+	}
+	err := s.server.Close()
+	os.Remove(s.socket)
+	return err
+}
+
+// handleReload asks the main loop to reload the config and reports the result to the caller.
+func (s *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := make(chan error, 1)
+	select {
+	case s.reloads <- result:
+	case <-r.Context().Done():
+		return
+	}
+
+	err := <-result
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
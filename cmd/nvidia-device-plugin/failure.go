@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+	"github.com/NVIDIA/k8s-device-plugin/internal/podresources"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+)
+
+// deviceFailureHandler acts on the pods using devices that become unhealthy or are removed from the node,
+// so that they are rescheduled instead of failing silently. The pods using a device are looked up through
+// the kubelet pod-resources API and then annotated or evicted according to config.Health.OnDeviceFailure.
+type deviceFailureHandler struct {
+	sync.Mutex
+	kubeconfig string
+	lister     podresources.Lister
+	policy     string
+	pods       *node.Pods
+
+	// resources holds all resources served since the handler was created, devices the IDs of the
+	// physical devices advertised by the last Update, and failed the IDs of those already acted on
+	resources map[string]bool
+	devices   map[string]bool
+	failed    map[string]bool
+	// seeded is set once the devices allocated before the handler was created have been added to devices
+	seeded bool
+
+	// pending tracks the pods being acted on in the background
+	pending sync.WaitGroup
+}
+
+// podKey identifies a pod by namespace and name.
+type podKey struct {
+	namespace string
+	name      string
+}
+
+// newDeviceFailureHandler creates a deviceFailureHandler.
+// It does nothing until a policy other than OnDeviceFailureIgnore is set through Update.
+func newDeviceFailureHandler(kubeconfig string) *deviceFailureHandler {
+	return &deviceFailureHandler{
+		kubeconfig: kubeconfig,
+		lister:     podresources.NewLister(podresources.DefaultSocket),
+		policy:     spec.OnDeviceFailureIgnore,
+		resources:  make(map[string]bool),
+		devices:    make(map[string]bool),
+		failed:     make(map[string]bool),
+	}
+}
+
+// Reset forgets about all devices already acted on. It is called whenever all plugins are restarted,
+// since the health of all devices is checked again from scratch.
+func (h *deviceFailureHandler) Reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.failed = make(map[string]bool)
+}
+
+// Update applies the policy set in 'config' and acts on all pods using physical devices that were advertised
+// by the previous Update (or allocated before the handler was created, see seed) but are not advertised by any
+// of 'plugins' anymore (e.g. after MIG reconfiguration).
+// Devices that are still advertised as part of any resource (e.g. because the resource was renamed or its
+// replicas changed) are not considered removed.
+func (h *deviceFailureHandler) Update(config *spec.Config, plugins []*NvidiaDevicePlugin) error {
+	h.Lock()
+	defer h.Unlock()
+
+	policy := config.Health.OnDeviceFailure
+	if policy == "" {
+		policy = spec.OnDeviceFailureIgnore
+	}
+	if policy != spec.OnDeviceFailureIgnore && h.pods == nil {
+		pods, err := node.NewPods(h.kubeconfig)
+		if err != nil {
+			return fmt.Errorf("error creating pods client: %v", err)
+		}
+		h.pods = pods
+	}
+	h.policy = policy
+	if policy != spec.OnDeviceFailureIgnore && !h.seeded {
+		h.seed()
+	}
+
+	devices := make(map[string]bool)
+	for _, p := range plugins {
+		h.resources[string(p.rm.Resource())] = true
+		for _, id := range rm.AnnotatedIDs(p.Devices().GetIDs()).GetIDs() {
+			devices[id] = true
+		}
+	}
+
+	removed := make(map[string]bool)
+	for id := range h.devices {
+		if !devices[id] {
+			removed[id] = true
+		}
+	}
+	h.devices = devices
+	if len(removed) == 0 {
+		return nil
+	}
+
+	resources := make(map[string]bool)
+	for resource := range h.resources {
+		resources[resource] = true
+	}
+
+	h.act("removed", func(resource string, id string) bool {
+		return resources[resource] && removed[rm.AnnotatedID(id).GetID()]
+	})
+
+	return nil
+}
+
+// seed adds the devices allocated to pods before the handler was created to the known devices and resources.
+// Devices only known this way are acted on if the next Update does not advertise them, so that pods still using
+// devices that disappeared while the plugin was not running (e.g. across a MIG reconfiguration) are handled too.
+// Seeding is retried on the next Update if the allocations cannot be listed. It must be called with the lock held.
+func (h *deviceFailureHandler) seed() {
+	allocations, err := h.lister.List()
+	if err != nil {
+		log.Printf("Failed to look up devices allocated before startup: %v", err)
+		return
+	}
+	for _, a := range allocations {
+		if !isPluginAllocation(a) {
+			continue
+		}
+		h.resources[a.Resource] = true
+		for _, id := range a.DeviceIDs {
+			h.devices[rm.AnnotatedID(id).GetID()] = true
+		}
+	}
+	h.seeded = true
+}
+
+// isPluginAllocation checks whether an allocation could have been made by this plugin, i.e. whether its resource
+// is in the nvidia.com namespace and all its devices are (replicas of) GPUs or MIG devices identified by UUID or index.
+// This excludes resources of other device plugins sharing the namespace, such as those of network devices.
+func isPluginAllocation(a podresources.Allocation) bool {
+	if !strings.HasPrefix(a.Resource, spec.ResourceNamePrefix+"/") {
+		return false
+	}
+	for _, id := range a.DeviceIDs {
+		ref := spec.ReplicatedDeviceRef(rm.AnnotatedID(id).GetID())
+		if !ref.IsUUID() && !ref.IsGPUIndex() && !ref.IsMigIndex() {
+			return false
+		}
+	}
+	return true
+}
+
+// DeviceFailed acts on the pods allocated the physical device with the given ID (or any of its replicas) as part of 'resource'.
+func (h *deviceFailureHandler) DeviceFailed(resource spec.ResourceName, id string) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.policy == spec.OnDeviceFailureIgnore || h.failed[id] {
+		return
+	}
+	h.failed[id] = true
+
+	h.act("unhealthy", func(r string, d string) bool {
+		return r == string(resource) && rm.AnnotatedID(d).GetID() == id
+	})
+}
+
+// DeviceRecovered marks the physical device with the given ID as healthy again, so that a later failure is acted on.
+func (h *deviceFailureHandler) DeviceRecovered(id string) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	delete(h.failed, id)
+}
+
+// act handles the pods allocated a device for which 'affected' returns true in the background.
+// It must be called with the lock held.
+func (h *deviceFailureHandler) act(reason string, affected func(resource string, id string) bool) {
+	if h.policy == spec.OnDeviceFailureIgnore {
+		return
+	}
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		h.handle(reason, affected)
+	}()
+}
+
+// handle annotates or evicts all pods allocated a device for which 'affected' returns true.
+// Pods whose eviction is refused (e.g. by a PodDisruptionBudget) are annotated instead.
+func (h *deviceFailureHandler) handle(reason string, affected func(resource string, id string) bool) {
+	h.Lock()
+	policy := h.policy
+	pods := h.pods
+	h.Unlock()
+
+	if policy == spec.OnDeviceFailureIgnore {
+		return
+	}
+
+	allocations, err := h.lister.List()
+	if err != nil {
+		log.Printf("Failed to look up pods using devices that are %s: %v", reason, err)
+		return
+	}
+
+	devices := make(map[podKey][]string)
+	for _, a := range allocations {
+		for _, id := range a.DeviceIDs {
+			if affected(a.Resource, id) {
+				key := podKey{a.Namespace, a.Pod}
+				devices[key] = append(devices[key], id)
+			}
+		}
+	}
+
+	var keys []podKey
+	for key := range devices {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	for _, key := range keys {
+		ids := devices[key]
+		sort.Strings(ids)
+
+		annotate := policy == spec.OnDeviceFailureAnnotate
+		if policy == spec.OnDeviceFailureEvict {
+			log.Printf("Evicting pod '%s/%s' using devices that are %s: %v", key.namespace, key.name, reason, ids)
+			evicted, err := pods.Evict(key.namespace, key.name)
+			if err != nil {
+				log.Printf("Failed to evict pod '%s/%s': %v", key.namespace, key.name, err)
+				continue
+			}
+			if !evicted {
+				log.Printf("Eviction of pod '%s/%s' was refused, annotating it instead", key.namespace, key.name)
+				annotate = true
+			}
+		}
+		if annotate {
+			log.Printf("Annotating pod '%s/%s' using devices that are %s: %v", key.namespace, key.name, reason, ids)
+			err := pods.Annotate(key.namespace, key.name, map[string]string{spec.FailedDevicesAnnotation: strings.Join(ids, ",")})
+			if err != nil {
+				log.Printf("Failed to annotate pod '%s/%s': %v", key.namespace, key.name, err)
+			}
+		}
+	}
+}
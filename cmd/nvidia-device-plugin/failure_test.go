@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+	"github.com/NVIDIA/k8s-device-plugin/internal/podresources"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type testLister []podresources.Allocation
+
+func (l testLister) List() ([]podresources.Allocation, error) {
+	return l, nil
+}
+
+// testAllocations allocates GPU-0 to pod 'default/a', GPU-1 to 'default/b', and replicas of GPU-2 to 'default/c'.
+var testAllocations = testLister{
+	{Namespace: "default", Pod: "a", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{"GPU-0"}},
+	{Namespace: "default", Pod: "b", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{"GPU-1"}},
+	{Namespace: "default", Pod: "c", Container: "main", Resource: "nvidia.com/gpu.shared", DeviceIDs: []string{"GPU-2::1", "GPU-2::0"}},
+}
+
+// newTestFailureHandler returns a handler with the given policy looking up the pods in testAllocations.
+func newTestFailureHandler(t *testing.T, policy string) (*deviceFailureHandler, *fake.Clientset) {
+	var objects []runtime.Object
+	for _, a := range testAllocations {
+		objects = append(objects, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: a.Namespace, Name: a.Pod}})
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+
+	h := newDeviceFailureHandler("")
+	h.lister = testAllocations
+	h.pods = node.NewPodsForClientset(clientset)
+
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	config.Health.OnDeviceFailure = policy
+	require.NoError(t, h.Update(config, defaultTestFailurePlugins(config)))
+	h.pending.Wait()
+	clientset.ClearActions()
+
+	return h, clientset
+}
+
+// defaultTestFailurePlugins returns the plugins advertising the devices in testAllocations.
+func defaultTestFailurePlugins(config *spec.Config) []*NvidiaDevicePlugin {
+	return []*NvidiaDevicePlugin{
+		newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+		newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1"),
+	}
+}
+
+// podActions returns '<verb> <namespace>/<name>' for all evictions and patches of pods, sorted.
+func podActions(t *testing.T, clientset *fake.Clientset) []string {
+	var actions []string
+	for _, a := range clientset.Actions() {
+		switch action := a.(type) {
+		case k8stesting.CreateAction:
+			if action.GetSubresource() != "eviction" {
+				continue
+			}
+			eviction, ok := action.GetObject().(metav1.Object)
+			require.True(t, ok)
+			actions = append(actions, "evict "+action.GetNamespace()+"/"+eviction.GetName())
+		case k8stesting.PatchAction:
+			actions = append(actions, "patch "+action.GetNamespace()+"/"+action.GetName())
+		}
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+func TestDeviceFailed(t *testing.T) {
+	testCases := []struct {
+		description string
+		policy      string
+		refuse      bool
+		resource    spec.ResourceName
+		id          string
+		expected    []string
+		annotations map[string]string
+	}{
+		{
+			description: "ignore does nothing",
+			policy:      spec.OnDeviceFailureIgnore,
+			resource:    "nvidia.com/gpu",
+			id:          "GPU-0",
+		},
+		{
+			description: "annotate sets failed devices",
+			policy:      spec.OnDeviceFailureAnnotate,
+			resource:    "nvidia.com/gpu",
+			id:          "GPU-0",
+			expected:    []string{"patch default/a"},
+			annotations: map[string]string{"a": "GPU-0"},
+		},
+		{
+			description: "annotate lists all failed replicas",
+			policy:      spec.OnDeviceFailureAnnotate,
+			resource:    "nvidia.com/gpu.shared",
+			id:          "GPU-2",
+			expected:    []string{"patch default/c"},
+			annotations: map[string]string{"c": "GPU-2::0,GPU-2::1"},
+		},
+		{
+			description: "other resources are not affected",
+			policy:      spec.OnDeviceFailureAnnotate,
+			resource:    "nvidia.com/gpu",
+			id:          "GPU-2",
+		},
+		{
+			description: "evict uses the eviction API",
+			policy:      spec.OnDeviceFailureEvict,
+			resource:    "nvidia.com/gpu",
+			id:          "GPU-1",
+			expected:    []string{"evict default/b"},
+		},
+		{
+			description: "refused evictions are annotated",
+			policy:      spec.OnDeviceFailureEvict,
+			refuse:      true,
+			resource:    "nvidia.com/gpu",
+			id:          "GPU-1",
+			expected:    []string{"evict default/b", "patch default/b"},
+			annotations: map[string]string{"b": "GPU-1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			h, clientset := newTestFailureHandler(t, tc.policy)
+			if tc.refuse {
+				clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					if action.GetSubresource() != "eviction" {
+						return false, nil, nil
+					}
+					return true, nil, errors.NewTooManyRequests("disruption budget", 0)
+				})
+			}
+
+			h.DeviceFailed(tc.resource, tc.id)
+			h.pending.Wait()
+
+			require.Equal(t, tc.expected, podActions(t, clientset))
+			for name, devices := range tc.annotations {
+				pod, err := clientset.CoreV1().Pods("default").Get(context.TODO(), name, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, devices, pod.Annotations[spec.FailedDevicesAnnotation])
+			}
+		})
+	}
+}
+
+func TestDeviceRecovered(t *testing.T) {
+	h, clientset := newTestFailureHandler(t, spec.OnDeviceFailureAnnotate)
+
+	h.DeviceFailed("nvidia.com/gpu", "GPU-0")
+	h.pending.Wait()
+	require.Equal(t, []string{"patch default/a"}, podActions(t, clientset))
+
+	clientset.ClearActions()
+	h.DeviceFailed("nvidia.com/gpu", "GPU-0")
+	h.pending.Wait()
+	require.Empty(t, podActions(t, clientset), "repeated failures are only acted on once")
+
+	h.DeviceRecovered("GPU-0")
+	h.DeviceFailed("nvidia.com/gpu", "GPU-0")
+	h.pending.Wait()
+	require.Equal(t, []string{"patch default/a"}, podActions(t, clientset), "failures after recovery are acted on")
+}
+
+func TestUpdate(t *testing.T) {
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	config.Health.OnDeviceFailure = spec.OnDeviceFailureAnnotate
+
+	testCases := []struct {
+		description string
+		plugins     []*NvidiaDevicePlugin
+		expected    []string
+	}{
+		{
+			description: "unchanged devices",
+			plugins:     defaultTestFailurePlugins(config),
+		},
+		{
+			description: "renamed resource",
+			plugins: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu.full", "GPU-0", "GPU-1"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1"),
+			},
+		},
+		{
+			description: "repartitioned replicas",
+			plugins: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1", "GPU-2::2", "GPU-2::3"),
+			},
+		},
+		{
+			description: "device moved to another resource",
+			plugins: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-1::0", "GPU-1::1", "GPU-2::0", "GPU-2::1"),
+			},
+		},
+		{
+			description: "removed device",
+			plugins: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1"),
+			},
+			expected: []string{"patch default/b"},
+		},
+		{
+			description: "removed shared device",
+			plugins: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+			},
+			expected: []string{"patch default/c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			h, clientset := newTestFailureHandler(t, spec.OnDeviceFailureAnnotate)
+
+			require.NoError(t, h.Update(config, tc.plugins))
+			h.pending.Wait()
+
+			require.Equal(t, tc.expected, podActions(t, clientset))
+		})
+	}
+}
+
+func TestUpdateIgnore(t *testing.T) {
+	h, clientset := newTestFailureHandler(t, spec.OnDeviceFailureAnnotate)
+
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	require.NoError(t, h.Update(config, nil))
+	h.pending.Wait()
+
+	require.Empty(t, podActions(t, clientset))
+}
+
+func TestUpdateSeedsAllocatedDevices(t *testing.T) {
+	const (
+		gpu0 = "GPU-4cf8db2d-06c0-7d70-1a51-e59b25b2c16c"
+		gpu1 = "GPU-662077db-fa3f-0d8f-9502-21ab0ef058a2"
+		mig  = "MIG-3eb87630-93d5-b2b6-b8ff-9b359caf4ee2"
+	)
+	// Allocations left over from before a restart, after which gpu0 is advertised as a whole GPU
+	// instead of the MIG device and gpu1 is gone.
+	allocations := testLister{
+		{Namespace: "default", Pod: "a", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{gpu0}},
+		{Namespace: "default", Pod: "b", Container: "main", Resource: "nvidia.com/gpu.shared", DeviceIDs: []string{gpu1 + "::0"}},
+		{Namespace: "default", Pod: "c", Container: "main", Resource: "nvidia.com/mig-1g.5gb", DeviceIDs: []string{mig}},
+		{Namespace: "default", Pod: "d", Container: "main", Resource: "nvidia.com/mlnxnics", DeviceIDs: []string{"0000:3b:00.1"}},
+		{Namespace: "default", Pod: "e", Container: "main", Resource: "example.com/gpu", DeviceIDs: []string{gpu1}},
+	}
+
+	var objects []runtime.Object
+	for _, a := range allocations {
+		objects = append(objects, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: a.Namespace, Name: a.Pod}})
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+
+	h := newDeviceFailureHandler("")
+	h.lister = allocations
+	h.pods = node.NewPodsForClientset(clientset)
+
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	config.Health.OnDeviceFailure = spec.OnDeviceFailureAnnotate
+	plugins := []*NvidiaDevicePlugin{newReloadTestPlugin(config, "nvidia.com/gpu", gpu0)}
+	require.NoError(t, h.Update(config, plugins))
+	h.pending.Wait()
+	require.Equal(t, []string{"patch default/b", "patch default/c"}, podActions(t, clientset))
+
+	clientset.ClearActions()
+	require.NoError(t, h.Update(config, plugins))
+	h.pending.Wait()
+	require.Empty(t, podActions(t, clientset), "allocations are only seeded once")
+}
+
+func TestUpdateSeeding(t *testing.T) {
+	h := newDeviceFailureHandler("")
+	h.lister = testAllocations
+	h.pods = node.NewPodsForClientset(fake.NewSimpleClientset())
+
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	require.NoError(t, h.Update(config, nil))
+	require.False(t, h.seeded, "nothing is seeded while failures are ignored")
+
+	config.Health.OnDeviceFailure = spec.OnDeviceFailureAnnotate
+	h.lister = failingLister{}
+	require.NoError(t, h.Update(config, nil))
+	require.False(t, h.seeded, "nothing is seeded without pod-resources")
+
+	h.lister = testAllocations
+	require.NoError(t, h.Update(config, nil))
+	require.True(t, h.seeded, "seeding is retried")
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+)
+
+// nodeHealthLabeler tracks unhealthy devices across all plugins and labels
+// the node while more than a configured number of them are unhealthy.
+type nodeHealthLabeler struct {
+	sync.Mutex
+	labeler   *node.Labeler
+	threshold int
+	unhealthy map[string]bool
+	labeled   bool
+}
+
+// newNodeHealthLabeler returns a nodeHealthLabeler if config.Health.UnhealthyNodeThreshold is set (nil otherwise).
+// Any label left over from a previous run is removed, since all devices start out healthy.
+func newNodeHealthLabeler(config *spec.Config, labeler *node.Labeler) (*nodeHealthLabeler, error) {
+	if config.Health.UnhealthyNodeThreshold == nil {
+		return nil, nil
+	}
+	if labeler == nil {
+		return nil, fmt.Errorf("labeling unhealthy nodes requires the node name to be set")
+	}
+
+	err := labeler.Update(nil, spec.UnhealthyNodeLabel)
+	if err != nil {
+		return nil, fmt.Errorf("error resetting '%v' label: %v", spec.UnhealthyNodeLabel, err)
+	}
+
+	l := &nodeHealthLabeler{
+		labeler:   labeler,
+		threshold: *config.Health.UnhealthyNodeThreshold,
+		unhealthy: make(map[string]bool),
+	}
+	return l, nil
+}
+
+// SetHealthy records the health of the physical device with the given ID, updating the node label if required.
+func (l *nodeHealthLabeler) SetHealthy(id string, healthy bool) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if healthy {
+		delete(l.unhealthy, id)
+	} else {
+		l.unhealthy[id] = true
+	}
+
+	exceeded := len(l.unhealthy) > l.threshold
+	if exceeded == l.labeled {
+		return
+	}
+
+	var err error
+	if exceeded {
+		log.Printf("%d devices are unhealthy, labeling node with %s=true", len(l.unhealthy), spec.UnhealthyNodeLabel)
+		err = l.labeler.Update(map[string]string{spec.UnhealthyNodeLabel: "true"})
+	} else {
+		log.Printf("%d devices are unhealthy, removing %s label from node", len(l.unhealthy), spec.UnhealthyNodeLabel)
+		err = l.labeler.Update(nil, spec.UnhealthyNodeLabel)
+	}
+	if err != nil {
+		log.Printf("Failed to update '%s' label: %v", spec.UnhealthyNodeLabel, err)
+		return
+	}
+	l.labeled = exceeded
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNodeName = "node"
+
+// newTestNodeClientset returns a fake clientset holding a single node with the given labels.
+func newTestNodeClientset(labels map[string]string) *fake.Clientset {
+	return fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Labels: labels},
+	})
+}
+
+// nodePatches returns the number of patches applied to nodes through 'clientset'.
+func nodePatches(clientset *fake.Clientset) int {
+	var patches int
+	for _, a := range clientset.Actions() {
+		if _, ok := a.(k8stesting.PatchAction); ok && a.GetResource().Resource == "nodes" {
+			patches++
+		}
+	}
+	return patches
+}
+
+func TestNodeHealthLabeler(t *testing.T) {
+	type step struct {
+		id      string
+		healthy bool
+		// labeled is whether the node is expected to be labeled after the step
+		labeled bool
+		// patched is whether the step is expected to patch the node
+		patched bool
+	}
+
+	testCases := []struct {
+		description string
+		threshold   int
+		steps       []step
+	}{
+		{
+			description: "crossing the threshold labels the node",
+			threshold:   1,
+			steps: []step{
+				{id: "GPU-0", healthy: false, labeled: false},
+				{id: "GPU-1", healthy: false, labeled: true, patched: true},
+				{id: "GPU-2", healthy: false, labeled: true},
+			},
+		},
+		{
+			description: "recovering below the threshold unlabels the node",
+			threshold:   1,
+			steps: []step{
+				{id: "GPU-0", healthy: false, labeled: false},
+				{id: "GPU-1", healthy: false, labeled: true, patched: true},
+				{id: "GPU-1", healthy: true, labeled: false, patched: true},
+				{id: "GPU-0", healthy: true, labeled: false},
+			},
+		},
+		{
+			description: "repeated failures of a device count once",
+			threshold:   1,
+			steps: []step{
+				{id: "GPU-0", healthy: false, labeled: false},
+				{id: "GPU-0", healthy: false, labeled: false},
+			},
+		},
+		{
+			description: "a zero threshold labels on the first failure",
+			threshold:   0,
+			steps: []step{
+				{id: "GPU-0", healthy: true, labeled: false},
+				{id: "GPU-0", healthy: false, labeled: true, patched: true},
+				{id: "GPU-0", healthy: true, labeled: false, patched: true},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			// A label left over from a previous run is removed on creation.
+			clientset := newTestNodeClientset(map[string]string{spec.UnhealthyNodeLabel: "true"})
+
+			config := &spec.Config{}
+			config.Health.UnhealthyNodeThreshold = &tc.threshold
+			l, err := newNodeHealthLabeler(config, node.NewLabelerForClientset(clientset, testNodeName))
+			require.NoError(t, err)
+
+			n, err := clientset.CoreV1().Nodes().Get(context.TODO(), testNodeName, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.NotContains(t, n.Labels, spec.UnhealthyNodeLabel)
+
+			for i, s := range tc.steps {
+				clientset.ClearActions()
+				l.SetHealthy(s.id, s.healthy)
+
+				patches := 0
+				if s.patched {
+					patches = 1
+				}
+				require.Equal(t, patches, nodePatches(clientset), "step %d", i)
+
+				n, err := clientset.CoreV1().Nodes().Get(context.TODO(), testNodeName, metav1.GetOptions{})
+				require.NoError(t, err)
+				_, labeled := n.Labels[spec.UnhealthyNodeLabel]
+				require.Equal(t, s.labeled, labeled, "step %d", i)
+			}
+		})
+	}
+}
+
+func TestNodeHealthLabelerDisabled(t *testing.T) {
+	l, err := newNodeHealthLabeler(&spec.Config{}, nil)
+	require.NoError(t, err)
+	require.Nil(t, l)
+
+	// A nil labeler ignores all updates.
+	l.SetHealthy("GPU-0", false)
+
+	config := &spec.Config{}
+	config.Health.UnhealthyNodeThreshold = ptr(1)
+	_, err = newNodeHealthLabeler(config, nil)
+	require.Error(t, err, "labeling requires a node")
+}
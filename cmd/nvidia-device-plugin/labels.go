@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+	"github.com/NVIDIA/k8s-device-plugin/internal/podresources"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+)
+
+// Constants for the node labels describing the sharing state of each resource
+const (
+	countLabelSuffix           = ".count"
+	replicasLabelSuffix        = ".replicas"
+	sharingStrategyLabelSuffix = ".sharing-strategy"
+	vgpuProfileLabelSuffix     = ".vgpu-profile"
+	allocatedLabelSuffix       = ".allocated"
+	freeLabelSuffix            = ".free"
+
+	migStrategyLabel = spec.ResourceNamePrefix + "/mig.strategy"
+
+	sharingLabelsAnnotation = spec.ResourceNamePrefix + "/device-plugin.sharing-labels"
+)
+
+// Variables for how often the sharing labels are refreshed
+var (
+	sharingLabelsRefreshInterval = 30 * time.Second
+	// sharingLabelsSettleDelay leaves the kubelet time to record an allocation before it is looked up.
+	sharingLabelsSettleDelay = 2 * time.Second
+)
+
+// Constants for the values of the sharing strategy label
+const (
+	sharingStrategyNone        = "none"
+	sharingStrategyTimeSlicing = "time-slicing"
+	sharingStrategyMPS         = "mps"
+	sharingStrategyFractional  = "fractional"
+)
+
+// sharingLabeler keeps the sharing labels of the node up to date while the plugins are running.
+// Besides the static sharing state of each resource, the labels report how many of its devices are allocated, as
+// looked up through the kubelet pod-resources API. Since the plugin is not told when devices are released, the
+// labels are refreshed periodically, as well as shortly after each allocation.
+type sharingLabeler struct {
+	sync.Mutex
+	labeler *node.Labeler
+	lister  podresources.Lister
+
+	// config and plugins are nil while sharing node labels are disabled
+	config  *spec.Config
+	plugins []*NvidiaDevicePlugin
+
+	// published holds the labels last set on the node, and listErr the last error listing the allocations
+	published map[string]string
+	listErr   string
+
+	refresh chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newSharingLabeler creates a sharingLabeler labeling the node through 'labeler' (nil if the node name is not set).
+// It does nothing until sharing node labels are enabled through Update.
+func newSharingLabeler(labeler *node.Labeler, lister podresources.Lister) *sharingLabeler {
+	return &sharingLabeler{
+		labeler: labeler,
+		lister:  lister,
+		refresh: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start starts refreshing the labels in the background.
+func (l *sharingLabeler) Start() {
+	go l.run()
+}
+
+// Stop stops refreshing the labels.
+func (l *sharingLabeler) Stop() {
+	close(l.stop)
+	<-l.done
+}
+
+// Update sets the plugins whose resources are described by the labels and labels the node accordingly.
+func (l *sharingLabeler) Update(config *spec.Config, plugins []*NvidiaDevicePlugin) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if !*config.Flags.Plugin.SharingNodeLabels {
+		l.config = nil
+		l.plugins = nil
+		return nil
+	}
+	if l.labeler == nil {
+		return fmt.Errorf("sharing node labels require the node name to be set")
+	}
+	l.config = config
+	l.plugins = plugins
+	l.published = nil
+
+	err := l.update()
+	if err != nil {
+		log.Printf("Failed to update sharing node labels: %v", err)
+	}
+	return nil
+}
+
+// Refresh requests the labels to be refreshed once the devices allocated by the kubelet have settled.
+func (l *sharingLabeler) Refresh() {
+	if l == nil {
+		return
+	}
+	select {
+	case l.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// run refreshes the labels every sharingLabelsRefreshInterval and sharingLabelsSettleDelay after each Refresh.
+func (l *sharingLabeler) run() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(sharingLabelsRefreshInterval)
+	defer ticker.Stop()
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.refresh:
+			if settled == nil {
+				settled = time.After(sharingLabelsSettleDelay)
+			}
+			continue
+		case <-settled:
+			settled = nil
+		case <-ticker.C:
+		}
+
+		l.Lock()
+		err := l.update()
+		l.Unlock()
+		if err != nil {
+			log.Printf("Failed to update sharing node labels: %v", err)
+		}
+	}
+}
+
+// update labels the node with the current sharing state if it changed since the last update.
+// It must be called with the lock held.
+func (l *sharingLabeler) update() error {
+	if l.config == nil {
+		return nil
+	}
+
+	// Allocation labels are omitted rather than reported wrong if the allocations cannot be looked up.
+	var allocated map[string]int
+	allocations, err := l.lister.List()
+	switch {
+	case err != nil && err.Error() != l.listErr:
+		log.Printf("Failed to look up allocated devices, omitting allocation labels: %v", err)
+		l.listErr = err.Error()
+	case err == nil:
+		allocated = countAllocated(allocations, l.plugins)
+		l.listErr = ""
+	}
+
+	labels := getSharingLabels(l.config, l.plugins, allocated)
+	if reflect.DeepEqual(labels, l.published) {
+		return nil
+	}
+
+	err = updateSharingLabels(l.labeler, labels)
+	if err != nil {
+		return err
+	}
+	l.published = labels
+	return nil
+}
+
+// updateSharingLabels sets 'labels' on the node.
+// The keys of the labels set are recorded in an annotation on the node, so
+// that only labels set by the plugin itself are removed once the resources
+// they describe are no longer served. Labels with the same keys set by other
+// components (such as GFD) are otherwise left alone.
+func updateSharingLabels(labeler *node.Labeler, labels map[string]string) error {
+	previous, err := labeler.Annotation(sharingLabelsAnnotation)
+	if err != nil {
+		return err
+	}
+	stale := getStaleSharingLabels(previous, labels)
+
+	annotations := map[string]string{
+		sharingLabelsAnnotation: formatSharingLabelKeys(labels),
+	}
+
+	log.Printf("Updating sharing node labels: %v", labels)
+	return labeler.UpdateWithAnnotations(labels, annotations, stale...)
+}
+
+// countAllocated returns the number of devices of each resource served by 'plugins' that are allocated to containers.
+func countAllocated(allocations []podresources.Allocation, plugins []*NvidiaDevicePlugin) map[string]int {
+	devices := make(map[string]rm.Devices)
+	for _, p := range plugins {
+		devices[string(p.rm.Resource())] = p.Devices()
+	}
+
+	allocated := make(map[string]map[string]bool)
+	for _, a := range allocations {
+		// Allocations of devices no longer served (e.g. after a reload) are not counted.
+		ds, served := devices[a.Resource]
+		if !served || !ds.Contains(a.DeviceIDs...) {
+			continue
+		}
+		if allocated[a.Resource] == nil {
+			allocated[a.Resource] = make(map[string]bool)
+		}
+		for _, id := range a.DeviceIDs {
+			allocated[a.Resource][id] = true
+		}
+	}
+
+	counts := make(map[string]int)
+	for resource := range devices {
+		counts[resource] = len(allocated[resource])
+	}
+	return counts
+}
+
+// getStaleSharingLabels returns the keys listed in 'previous' (as recorded in
+// the sharing labels annotation) that are not part of 'labels'.
+func getStaleSharingLabels(previous string, labels map[string]string) []string {
+	var stale []string
+	for _, k := range strings.Split(previous, ",") {
+		if k == "" {
+			continue
+		}
+		if _, exists := labels[k]; exists {
+			continue
+		}
+		stale = append(stale, k)
+	}
+	return stale
+}
+
+// formatSharingLabelKeys returns the sorted keys of 'labels' as the value of the sharing labels annotation.
+func formatSharingLabelKeys(labels map[string]string) string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// getSharingLabels builds the set of sharing labels for all resources served by 'plugins'.
+// If 'allocated' is nil, the labels reporting the number of allocated and free devices of each resource are omitted.
+func getSharingLabels(config *spec.Config, plugins []*NvidiaDevicePlugin, allocated map[string]int) map[string]string {
+	labels := map[string]string{
+		migStrategyLabel: *config.Flags.MigStrategy,
+	}
+
+	for _, p := range plugins {
+		devices := p.Devices()
+		if len(devices) == 0 {
+			continue
+		}
+
+		replicas := make(map[string]int)
+		for _, d := range devices {
+			replicas[rm.AnnotatedID(d.ID).GetID()]++
+		}
+		maxReplicas := 0
+		for _, n := range replicas {
+			if n > maxReplicas {
+				maxReplicas = n
+			}
+		}
+
+		strategy := sharingStrategyNone
+		if rm.AnnotatedIDs(devices.GetIDs()).AnyHasAnnotations() {
+			strategy = sharingStrategyTimeSlicing
+		}
+		if p.mps != nil {
+			strategy = sharingStrategyMPS
+		}
+		if p.fractional {
+			strategy = sharingStrategyFractional
+		}
+
+		resource := string(p.rm.Resource())
+		labels[resource+countLabelSuffix] = fmt.Sprintf("%d", len(replicas))
+		labels[resource+replicasLabelSuffix] = fmt.Sprintf("%d", maxReplicas)
+		labels[resource+sharingStrategyLabelSuffix] = strategy
+
+		if allocated != nil {
+			labels[resource+allocatedLabelSuffix] = fmt.Sprintf("%d", allocated[resource])
+			labels[resource+freeLabelSuffix] = fmt.Sprintf("%d", len(devices)-allocated[resource])
+		}
+
+		if profile := getVGPUProfile(devices); profile != "" {
+			labels[resource+vgpuProfileLabelSuffix] = profile
+		}
+	}
+
+	return labels
+}
+
+// getVGPUProfile returns the vGPU profile shared by all 'devices' as a valid label value.
+// If the devices are not vGPUs or are backed by different profiles, "" is returned.
+func getVGPUProfile(devices rm.Devices) string {
+	profile := ""
+	for _, d := range devices {
+		if d.VGPUProfile == "" {
+			return ""
+		}
+		if profile != "" && d.VGPUProfile != profile {
+			return ""
+		}
+		profile = d.VGPUProfile
+	}
+
+	value := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r == ' ':
+			return '-'
+		}
+		return -1
+	}, profile)
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
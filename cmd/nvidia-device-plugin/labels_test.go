@@ -0,0 +1,404 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+	"github.com/NVIDIA/k8s-device-plugin/internal/podresources"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestGetSharingLabels(t *testing.T) {
+	withProfile := func(profile string, devices rm.Devices) rm.Devices {
+		for _, d := range devices {
+			d.VGPUProfile = profile
+		}
+		return devices
+	}
+
+	testCases := []struct {
+		description string
+		devices     rm.Devices
+		mps         bool
+		fractional  bool
+		allocated   map[string]int
+		expected    map[string]string
+	}{
+		{
+			description: "no devices",
+			devices:     rm.Devices{},
+			expected: map[string]string{
+				"nvidia.com/mig.strategy": "none",
+			},
+		},
+		{
+			description: "full GPUs",
+			devices:     newTestDevices("GPU-0", "GPU-1"),
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "2",
+				"nvidia.com/gpu.replicas":         "1",
+				"nvidia.com/gpu.sharing-strategy": "none",
+			},
+		},
+		{
+			description: "time-sliced GPUs",
+			devices:     newTestDevices("GPU-0::0", "GPU-0::1", "GPU-1::0", "GPU-1::1"),
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "2",
+				"nvidia.com/gpu.replicas":         "2",
+				"nvidia.com/gpu.sharing-strategy": "time-slicing",
+			},
+		},
+		{
+			description: "MPS shared GPU",
+			devices:     newTestDevices("GPU-0::0", "GPU-0::1", "GPU-0::2"),
+			mps:         true,
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "1",
+				"nvidia.com/gpu.replicas":         "3",
+				"nvidia.com/gpu.sharing-strategy": "mps",
+			},
+		},
+		{
+			description: "fractional GPU",
+			devices:     newTestDevices("GPU-0::0", "GPU-0::1"),
+			mps:         true,
+			fractional:  true,
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "1",
+				"nvidia.com/gpu.replicas":         "2",
+				"nvidia.com/gpu.sharing-strategy": "fractional",
+			},
+		},
+		{
+			description: "allocated time-sliced GPUs",
+			devices:     newTestDevices("GPU-0::0", "GPU-0::1", "GPU-1::0", "GPU-1::1"),
+			allocated:   map[string]int{"nvidia.com/gpu": 3},
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "2",
+				"nvidia.com/gpu.replicas":         "2",
+				"nvidia.com/gpu.sharing-strategy": "time-slicing",
+				"nvidia.com/gpu.allocated":        "3",
+				"nvidia.com/gpu.free":             "1",
+			},
+		},
+		{
+			description: "no allocated GPUs",
+			devices:     newTestDevices("GPU-0", "GPU-1"),
+			allocated:   map[string]int{},
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "2",
+				"nvidia.com/gpu.replicas":         "1",
+				"nvidia.com/gpu.sharing-strategy": "none",
+				"nvidia.com/gpu.allocated":        "0",
+				"nvidia.com/gpu.free":             "2",
+			},
+		},
+		{
+			description: "vGPUs",
+			devices:     withProfile("GRID T4-4C", newTestDevices("GPU-0", "GPU-1")),
+			expected: map[string]string{
+				"nvidia.com/mig.strategy":         "none",
+				"nvidia.com/gpu.count":            "2",
+				"nvidia.com/gpu.replicas":         "1",
+				"nvidia.com/gpu.sharing-strategy": "none",
+				"nvidia.com/gpu.vgpu-profile":     "GRID-T4-4C",
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			plugin := newTestPlugin(t, spec.DeviceListStrategyEnvvar, tc.devices)
+			if tc.mps {
+				plugin.mps = &spec.ReplicatedResource{Name: "nvidia.com/gpu", Replicas: len(tc.devices)}
+			}
+			plugin.fractional = tc.fractional
+
+			labels := getSharingLabels(plugin.config, []*NvidiaDevicePlugin{plugin}, tc.allocated)
+			require.Equal(t, tc.expected, labels)
+		})
+	}
+}
+
+func TestCountAllocated(t *testing.T) {
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	plugins := []*NvidiaDevicePlugin{
+		newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+		newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1", "GPU-2::2"),
+	}
+
+	testCases := []struct {
+		description string
+		allocations []podresources.Allocation
+		expected    map[string]int
+	}{
+		{
+			description: "no allocations",
+			expected:    map[string]int{"nvidia.com/gpu": 0, "nvidia.com/gpu.shared": 0},
+		},
+		{
+			description: "allocations across containers",
+			allocations: []podresources.Allocation{
+				{Namespace: "default", Pod: "a", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{"GPU-0"}},
+				{Namespace: "default", Pod: "b", Container: "main", Resource: "nvidia.com/gpu.shared", DeviceIDs: []string{"GPU-2::0", "GPU-2::2"}},
+				{Namespace: "default", Pod: "c", Container: "main", Resource: "nvidia.com/gpu.shared", DeviceIDs: []string{"GPU-2::1"}},
+			},
+			expected: map[string]int{"nvidia.com/gpu": 1, "nvidia.com/gpu.shared": 3},
+		},
+		{
+			description: "allocations of other or no longer served devices are ignored",
+			allocations: []podresources.Allocation{
+				{Namespace: "default", Pod: "a", Container: "main", Resource: "example.com/nic", DeviceIDs: []string{"NIC-0"}},
+				{Namespace: "default", Pod: "b", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{"GPU-3"}},
+				{Namespace: "default", Pod: "c", Container: "main", Resource: "nvidia.com/gpu.shared", DeviceIDs: []string{"GPU-2::3"}},
+			},
+			expected: map[string]int{"nvidia.com/gpu": 0, "nvidia.com/gpu.shared": 0},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			require.Equal(t, tc.expected, countAllocated(tc.allocations, plugins))
+		})
+	}
+}
+
+type failingLister struct{}
+
+func (failingLister) List() ([]podresources.Allocation, error) {
+	return nil, fmt.Errorf("no pod-resources socket")
+}
+
+func TestSharingLabelerUpdate(t *testing.T) {
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	config.Flags.Plugin.SharingNodeLabels = ptr(true)
+	plugins := []*NvidiaDevicePlugin{
+		newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+	}
+	getLabels := func(clientset *fake.Clientset) map[string]string {
+		n, err := clientset.CoreV1().Nodes().Get(context.TODO(), testNodeName, metav1.GetOptions{})
+		require.NoError(t, err)
+		return n.Labels
+	}
+
+	t.Run("allocation labels follow the allocations", func(t *testing.T) {
+		clientset := newTestNodeClientset(nil)
+		lister := testLister{
+			{Namespace: "default", Pod: "a", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{"GPU-0"}},
+		}
+		l := newSharingLabeler(node.NewLabelerForClientset(clientset, testNodeName), &lister)
+
+		require.NoError(t, l.Update(config, plugins))
+		require.Equal(t, "1", getLabels(clientset)["nvidia.com/gpu.allocated"])
+		require.Equal(t, "1", getLabels(clientset)["nvidia.com/gpu.free"])
+
+		// Unchanged labels are not patched again.
+		clientset.ClearActions()
+		require.NoError(t, l.update())
+		require.Equal(t, 0, nodePatches(clientset))
+
+		lister = nil
+		require.NoError(t, l.update())
+		require.Equal(t, 1, nodePatches(clientset))
+		require.Equal(t, "0", getLabels(clientset)["nvidia.com/gpu.allocated"])
+		require.Equal(t, "2", getLabels(clientset)["nvidia.com/gpu.free"])
+	})
+
+	t.Run("allocation labels are omitted without pod-resources", func(t *testing.T) {
+		clientset := newTestNodeClientset(nil)
+		l := newSharingLabeler(node.NewLabelerForClientset(clientset, testNodeName), failingLister{})
+
+		require.NoError(t, l.Update(config, plugins))
+		labels := getLabels(clientset)
+		require.Equal(t, "2", labels["nvidia.com/gpu.count"])
+		require.NotContains(t, labels, "nvidia.com/gpu.allocated")
+		require.NotContains(t, labels, "nvidia.com/gpu.free")
+	})
+
+	t.Run("disabled labels leave the node alone", func(t *testing.T) {
+		clientset := newTestNodeClientset(nil)
+		l := newSharingLabeler(node.NewLabelerForClientset(clientset, testNodeName), testLister{})
+
+		disabled := newTestConfig(spec.DeviceListStrategyEnvvar)
+		disabled.Flags.Plugin.SharingNodeLabels = ptr(false)
+		require.NoError(t, l.Update(disabled, plugins))
+		require.NoError(t, l.update())
+		require.Equal(t, 0, nodePatches(clientset))
+	})
+
+	t.Run("labels require a node", func(t *testing.T) {
+		l := newSharingLabeler(nil, testLister{})
+		require.Error(t, l.Update(config, plugins))
+	})
+}
+
+func TestSharingLabelerRefresh(t *testing.T) {
+	defer func(delay time.Duration) { sharingLabelsSettleDelay = delay }(sharingLabelsSettleDelay)
+	sharingLabelsSettleDelay = time.Millisecond
+
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	config.Flags.Plugin.SharingNodeLabels = ptr(true)
+	plugin := newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1")
+
+	clientset := newTestNodeClientset(nil)
+	var lister testLister
+	l := newSharingLabeler(node.NewLabelerForClientset(clientset, testNodeName), &lister)
+	require.NoError(t, l.Update(config, []*NvidiaDevicePlugin{plugin}))
+	plugin.sharingLabels = l
+
+	l.Start()
+	defer l.Stop()
+
+	// The allocation only shows up in pod-resources once Allocate has returned.
+	_, err := plugin.Allocate(context.TODO(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-1"}}},
+	})
+	require.NoError(t, err)
+	l.Lock()
+	lister = testLister{{Namespace: "default", Pod: "a", Container: "main", Resource: "nvidia.com/gpu", DeviceIDs: []string{"GPU-1"}}}
+	l.Unlock()
+
+	require.Eventually(t, func() bool {
+		n, err := clientset.CoreV1().Nodes().Get(context.TODO(), testNodeName, metav1.GetOptions{})
+		return err == nil && n.Labels["nvidia.com/gpu.allocated"] == "1"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestGetStaleSharingLabels(t *testing.T) {
+	testCases := []struct {
+		description string
+		previous    string
+		labels      map[string]string
+		expected    []string
+	}{
+		{
+			description: "no previous labels",
+			previous:    "",
+			labels:      map[string]string{"nvidia.com/gpu.count": "1"},
+			expected:    nil,
+		},
+		{
+			description: "same labels",
+			previous:    "nvidia.com/gpu.count,nvidia.com/mig.strategy",
+			labels:      map[string]string{"nvidia.com/gpu.count": "2", "nvidia.com/mig.strategy": "none"},
+			expected:    nil,
+		},
+		{
+			description: "resource renamed",
+			previous:    "nvidia.com/gpu.count,nvidia.com/gpu.replicas,nvidia.com/mig.strategy",
+			labels:      map[string]string{"nvidia.com/gpu.shared.count": "1", "nvidia.com/mig.strategy": "none"},
+			expected:    []string{"nvidia.com/gpu.count", "nvidia.com/gpu.replicas"},
+		},
+		{
+			description: "previously set label no longer set",
+			previous:    "nvidia.com/mig.strategy",
+			labels:      map[string]string{},
+			expected:    []string{"nvidia.com/mig.strategy"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			stale := getStaleSharingLabels(tc.previous, tc.labels)
+			require.Equal(t, tc.expected, stale)
+		})
+	}
+}
+
+func TestFormatSharingLabelKeys(t *testing.T) {
+	labels := map[string]string{
+		"nvidia.com/mig.strategy": "none",
+		"nvidia.com/gpu.count":    "1",
+	}
+	value := formatSharingLabelKeys(labels)
+	require.Equal(t, "nvidia.com/gpu.count,nvidia.com/mig.strategy", value)
+	require.Empty(t, getStaleSharingLabels(value, labels))
+}
+
+func TestGetVGPUProfile(t *testing.T) {
+	newDevices := func(profiles ...string) rm.Devices {
+		devices := make(rm.Devices)
+		for i, profile := range profiles {
+			d := &rm.Device{VGPUProfile: profile}
+			d.ID = fmt.Sprintf("GPU-%d", i)
+			devices[d.ID] = d
+		}
+		return devices
+	}
+
+	testCases := []struct {
+		devices  rm.Devices
+		expected string
+	}{
+		{
+			devices:  newDevices(),
+			expected: "",
+		},
+		{
+			devices:  newDevices(""),
+			expected: "",
+		},
+		{
+			devices:  newDevices("GRID T4-4C", "GRID T4-4C"),
+			expected: "GRID-T4-4C",
+		},
+		{
+			devices:  newDevices("GRID T4-4C", "GRID T4-8C"),
+			expected: "",
+		},
+		{
+			devices:  newDevices("GRID T4-4C", ""),
+			expected: "",
+		},
+		{
+			devices:  newDevices("NVIDIA A100-PCIE-40GB (4C)"),
+			expected: "NVIDIA-A100-PCIE-40GB-4C",
+		},
+		{
+			devices:  newDevices(" GRID/T4 "),
+			expected: "GRIDT4",
+		},
+		{
+			devices:  newDevices(strings.Repeat("a", 62) + "-b"),
+			expected: strings.Repeat("a", 62),
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.expected, getVGPUProfile(tc.devices))
+		})
+	}
+}
@@ -26,7 +26,13 @@ import (
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/audit"
+	"github.com/NVIDIA/k8s-device-plugin/internal/cdi"
+	"github.com/NVIDIA/k8s-device-plugin/internal/node"
+	"github.com/NVIDIA/k8s-device-plugin/internal/pairing"
+	"github.com/NVIDIA/k8s-device-plugin/internal/podresources"
 	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm/fake"
 	"github.com/fsnotify/fsnotify"
 	cli "github.com/urfave/cli/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -34,6 +40,12 @@ import (
 
 var version string // This should be set at build time to indicate the actual version
 
+// Constants for the backends used to discover devices
+const (
+	deviceBackendNVML = "nvml"
+	deviceBackendFake = "fake"
+)
+
 func main() {
 	var configFile string
 
@@ -71,7 +83,7 @@ func main() {
 		&cli.StringFlag{
 			Name:    "device-list-strategy",
 			Value:   spec.DeviceListStrategyEnvvar,
-			Usage:   "the desired strategy for passing the device list to the underlying runtime:\n\t\t[envvar | volume-mounts]",
+			Usage:   "the desired strategy for passing the device list to the underlying runtime:\n\t\t[envvar | volume-mounts | cdi-annotations]",
 			EnvVars: []string{"DEVICE_LIST_STRATEGY"},
 		},
 		&cli.StringFlag{
@@ -80,6 +92,71 @@ func main() {
 			Usage:   "the desired strategy for passing device IDs to the underlying runtime:\n\t\t[uuid | index]",
 			EnvVars: []string{"DEVICE_ID_STRATEGY"},
 		},
+		&cli.StringFlag{
+			Name:    "container-driver-root",
+			Usage:   "the path the NVIDIA driver root is mounted at inside the plugin container, used to find the driver files to put in CDI specs (defaults to --nvidia-driver-root)",
+			EnvVars: []string{"CONTAINER_DRIVER_ROOT"},
+		},
+		&cli.StringFlag{
+			Name:    "nvidia-ctk-path",
+			Value:   cdi.DefaultNvidiaCTKPath,
+			Usage:   "the path of the nvidia-ctk binary on the host, run by the hooks in generated CDI specs",
+			EnvVars: []string{"NVIDIA_CTK_PATH"},
+		},
+		&cli.BoolFlag{
+			Name:    "sharing-node-labels",
+			Value:   false,
+			Usage:   "label the node with the number of replicas, sharing strategy, and allocated replicas of each resource being served",
+			EnvVars: []string{"SHARING_NODE_LABELS"},
+		},
+		&cli.StringFlag{
+			Name:    "node-name",
+			Usage:   "the name of the node the plugin is running on (required to label the node)",
+			EnvVars: []string{"NODE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    "kubeconfig",
+			Usage:   "absolute path to the kubeconfig file used to label the node (defaults to the in-cluster config)",
+			EnvVars: []string{"KUBECONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:    "watch-config-file",
+			Value:   false,
+			Usage:   "reload the config file whenever it changes, restarting only the plugins whose resources are affected",
+			EnvVars: []string{"WATCH_CONFIG_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-socket",
+			Usage:   "the path of a Unix socket to serve admin requests (e.g. POST /reload) on",
+			EnvVars: []string{"ADMIN_SOCKET"},
+		},
+		&cli.StringFlag{
+			Name:    "device-backend",
+			Value:   deviceBackendNVML,
+			Usage:   "the backend used to discover devices:\n\t\t[nvml | fake]",
+			EnvVars: []string{"DEVICE_BACKEND"},
+		},
+		&cli.StringFlag{
+			Name:    "fake-device-fixture",
+			Usage:   "the path to a YAML fixture describing the simulated devices served with --device-backend=fake",
+			EnvVars: []string{"FAKE_DEVICE_FIXTURE"},
+		},
+		&cli.StringFlag{
+			Name:    "audit-log",
+			Usage:   "the path of a file to append a JSON record of every allocation decision to ('-' for stdout, prefixed with 'audit: ')",
+			EnvVars: []string{"AUDIT_LOG"},
+		},
+		&cli.IntFlag{
+			Name:    "audit-log-max-size",
+			Value:   100,
+			Usage:   "the size in MiB after which the audit log file is rotated, keeping one previous file ('0' lets it grow without bounds)",
+			EnvVars: []string{"AUDIT_LOG_MAX_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:    "nic-pairing-hint-file",
+			Usage:   "the path of a file to write the RDMA NIC closest to each GPU to, for use by an RDMA device plugin",
+			EnvVars: []string{"NIC_PAIRING_HINT_FILE"},
+		},
 		&cli.StringFlag{
 			Name:        "config-file",
 			Usage:       "the path to a config file as an alternative to command line options or environment variables",
@@ -97,7 +174,14 @@ func main() {
 }
 
 func validateFlags(config *spec.Config) error {
-	if *config.Flags.Plugin.DeviceListStrategy != spec.DeviceListStrategyEnvvar && *config.Flags.Plugin.DeviceListStrategy != spec.DeviceListStrategyVolumeMounts {
+	switch *config.Flags.Plugin.DeviceListStrategy {
+	case spec.DeviceListStrategyEnvvar:
+	case spec.DeviceListStrategyVolumeMounts:
+	case spec.DeviceListStrategyCDIAnnotations:
+	case spec.DeviceListStrategyCDICRI:
+		// The device plugin API we build against has no CDIDevices field in its AllocateResponse.
+		return fmt.Errorf("unsupported --device-list-strategy option: %v (use %v instead)", spec.DeviceListStrategyCDICRI, spec.DeviceListStrategyCDIAnnotations)
+	default:
 		return fmt.Errorf("invalid --device-list-strategy option: %v", *config.Flags.Plugin.DeviceListStrategy)
 	}
 
@@ -107,6 +191,18 @@ func validateFlags(config *spec.Config) error {
 	return nil
 }
 
+func validateHealth(config *spec.Config) error {
+	switch config.Health.OnDeviceFailure {
+	case "":
+	case spec.OnDeviceFailureIgnore:
+	case spec.OnDeviceFailureAnnotate:
+	case spec.OnDeviceFailureEvict:
+	default:
+		return fmt.Errorf("invalid health.onDeviceFailure option: %v", config.Health.OnDeviceFailure)
+	}
+	return nil
+}
+
 func loadConfig(c *cli.Context, flags []cli.Flag) (*spec.Config, error) {
 	config, err := spec.NewConfig(c, flags)
 	if err != nil {
@@ -116,11 +212,33 @@ func loadConfig(c *cli.Context, flags []cli.Flag) (*spec.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to validate flags: %v", err)
 	}
+	err = validateHealth(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to validate health options: %v", err)
+	}
 	config.Flags.GFD = nil
 	return config, nil
 }
 
+func validateDeviceBackend(c *cli.Context) error {
+	switch c.String("device-backend") {
+	case deviceBackendNVML:
+	case deviceBackendFake:
+		if c.String("fake-device-fixture") == "" {
+			return fmt.Errorf("--device-backend=%v requires --fake-device-fixture to be set", deviceBackendFake)
+		}
+	default:
+		return fmt.Errorf("invalid --device-backend option: %v", c.String("device-backend"))
+	}
+	return nil
+}
+
 func start(c *cli.Context, flags []cli.Flag) error {
+	err := validateDeviceBackend(c)
+	if err != nil {
+		return err
+	}
+
 	log.Println("Starting FS watcher.")
 	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
 	if err != nil {
@@ -131,20 +249,66 @@ func start(c *cli.Context, flags []cli.Flag) error {
 	log.Println("Starting OS watcher.")
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	configFile := c.String("config-file")
+	var configWatcher *configFileWatcher
+	var configEvents <-chan fsnotify.Event
+	var configErrors <-chan error
+	if c.Bool("watch-config-file") && configFile != "" {
+		log.Println("Starting config file watcher.")
+		configWatcher, err = newConfigFileWatcher(configFile)
+		if err != nil {
+			return fmt.Errorf("failed to create config file watcher: %v", err)
+		}
+		defer configWatcher.Close()
+		configEvents = configWatcher.Events
+		configErrors = configWatcher.Errors
+	}
+
+	var admin *adminServer
+	if c.String("admin-socket") != "" {
+		log.Println("Starting admin server.")
+		admin, err = newAdminServer(c.String("admin-socket"))
+		if err != nil {
+			return fmt.Errorf("failed to create admin server: %v", err)
+		}
+		defer admin.Close()
+	}
+
+	var auditLog *audit.Log
+	if c.String("audit-log") != "" {
+		log.Println("Opening allocation audit log.")
+		auditLog, err = audit.Open(c.String("audit-log"), int64(c.Int("audit-log-max-size"))<<20)
+		if err != nil {
+			return fmt.Errorf("failed to open allocation audit log: %v", err)
+		}
+		defer auditLog.Close()
+	}
+
+	failures := newDeviceFailureHandler(c.String("kubeconfig"))
+
+	labeler, err := newNodeLabeler(c)
+	if err != nil {
+		return fmt.Errorf("failed to create node labeler: %v", err)
+	}
+	sharingLabels := newSharingLabeler(labeler, podresources.NewLister(podresources.DefaultSocket))
+	sharingLabels.Start()
+	defer sharingLabels.Stop()
+
 	var restarting bool
 	var restartTimeout <-chan time.Time
+	var reloadTimeout <-chan time.Time
 	var plugins []*NvidiaDevicePlugin
 restart:
 	// If we are restarting, stop plugins from previous run.
 	if restarting {
-		err := stopPlugins(plugins)
+		err := stopPlugins(c, plugins)
 		if err != nil {
 			return fmt.Errorf("error stopping plugins from previous run: %v", err)
 		}
 	}
 
 	log.Println("Starting Plugins.")
-	plugins, restartPlugins, err := startPlugins(c, flags, restarting)
+	plugins, restartPlugins, err := startPlugins(c, flags, restarting, failures, sharingLabels, auditLog)
 	if err != nil {
 		return fmt.Errorf("error starting plugins: %v", err)
 	}
@@ -177,6 +341,36 @@ restart:
 		case err := <-watcher.Errors:
 			log.Printf("inotify: %s", err)
 
+		// Reload the config when the config file changes. Updates to a
+		// mounted ConfigMap arrive as a burst of events, so let them settle
+		// before reloading.
+		case event := <-configEvents:
+			if configWatcher.IsConfigFileEvent(event) {
+				reloadTimeout = time.After(time.Second)
+			}
+
+		case err := <-configErrors:
+			log.Printf("inotify: %s", err)
+
+		case <-reloadTimeout:
+			var restartAll bool
+			plugins, restartAll, err = reloadPlugins(c, flags, plugins)
+			if err != nil {
+				log.Printf("Failed to reload config: %v", err)
+			}
+			if restartAll {
+				goto restart
+			}
+
+		// Reload the config on request of the admin endpoint and report the result.
+		case result := <-admin.Reloads():
+			var restartAll bool
+			plugins, restartAll, err = reloadPlugins(c, flags, plugins)
+			result <- err
+			if restartAll {
+				goto restart
+			}
+
 		// Watch for any signals from the OS. On SIGHUP, restart this loop,
 		// restarting all of the plugins in the process. On all other
 		// signals, exit the loop and exit the program.
@@ -192,59 +386,78 @@ restart:
 		}
 	}
 exit:
-	err = stopPlugins(plugins)
+	err = stopPlugins(c, plugins)
 	if err != nil {
 		return fmt.Errorf("error stopping plugins: %v", err)
 	}
 	return nil
 }
 
-func startPlugins(c *cli.Context, flags []cli.Flag, restarting bool) ([]*NvidiaDevicePlugin, bool, error) {
+func startPlugins(c *cli.Context, flags []cli.Flag, restarting bool, failures *deviceFailureHandler, sharingLabels *sharingLabeler, auditLog *audit.Log) ([]*NvidiaDevicePlugin, bool, error) {
 	// Load the configuration file
 	log.Println("Loading configuration.")
 	config, err := loadConfig(c, flags)
 	if err != nil {
 		return nil, false, fmt.Errorf("unable to load config: %v", err)
 	}
-	disableResourceRenamingInConfig(config)
 
 	// Start NVML
-	log.Println("Initializing NVML.")
-	if err := nvml.Init(); err != nil {
-		log.SetOutput(os.Stderr)
-		log.Printf("Failed to initialize NVML: %v.", err)
-		log.Printf("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
-		log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
-		log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
-		log.Printf("If this is not a GPU node, you should set up a toleration or nodeSelector to only deploy this plugin on GPU nodes")
-		log.SetOutput(os.Stdout)
-		if *config.Flags.FailOnInitError {
-			return nil, false, fmt.Errorf("failed to initialize NVML: %v", err)
+	if c.String("device-backend") == deviceBackendFake {
+		log.Println("Serving simulated devices, skipping NVML initialization.")
+	} else {
+		log.Println("Initializing NVML.")
+		if err := nvml.Init(); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Printf("Failed to initialize NVML: %v.", err)
+			log.Printf("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
+			log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
+			log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
+			log.Printf("If this is not a GPU node, you should set up a toleration or nodeSelector to only deploy this plugin on GPU nodes")
+			log.SetOutput(os.Stdout)
+			if *config.Flags.FailOnInitError {
+				return nil, false, fmt.Errorf("failed to initialize NVML: %v", err)
+			}
+			select {}
 		}
-		select {}
 	}
 
-	// Update the configuration file with default resources.
-	log.Println("Updating config with default resource matching patterns.")
-	err = rm.AddDefaultResourcesToConfig(config)
+	plugins, err := newPlugins(c, config)
 	if err != nil {
-		return nil, false, fmt.Errorf("unable to add default resources to config: %v", err)
+		return nil, false, err
 	}
 
-	// Print the config to the output.
-	configJSON, err := json.MarshalIndent(config, "", "  ")
+	// Set up labeling of the node based on the health of its devices.
+	labeler, err := newNodeLabeler(c)
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to marshal config to JSON: %v", err)
+		return nil, false, fmt.Errorf("error creating node labeler: %v", err)
+	}
+	nodeHealth, err := newNodeHealthLabeler(config, labeler)
+	if err != nil {
+		return nil, false, fmt.Errorf("error creating node health labeler: %v", err)
+	}
+	for _, p := range plugins {
+		p.nodeHealth = nodeHealth
+		p.failures = failures
+		p.sharingLabels = sharingLabels
+		p.audit = auditLog
 	}
-	log.Printf("\nRunning with config:\n%v", string(configJSON))
 
-	// Get the set of plugins.
-	log.Println("Retreiving plugins.")
-	migStrategy, err := NewMigStrategy(config)
+	// Act on pods using devices that disappeared since the plugins were last started.
+	failures.Reset()
+	err = failures.Update(config, plugins)
 	if err != nil {
-		return nil, false, fmt.Errorf("error creating MIG strategy: %v", err)
+		return nil, false, fmt.Errorf("error setting up device failure handling: %v", err)
+	}
+
+	err = sharingLabels.Update(config, plugins)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = writeNICPairingHints(c, plugins)
+	if err != nil {
+		return nil, false, err
 	}
-	plugins := migStrategy.GetPlugins()
 
 	// Loop through all plugins, starting them if they have any devices
 	// to serve. If even one plugin fails to start properly, try
@@ -257,12 +470,7 @@ func startPlugins(c *cli.Context, flags []cli.Flag, restarting bool) ([]*NvidiaD
 		}
 
 		// Start the gRPC server for plugin p and connect it with the kubelet.
-		if err := p.Start(); err != nil {
-			log.SetOutput(os.Stderr)
-			log.Println("Could not contact Kubelet. Did you enable the device plugin feature gate?")
-			log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
-			log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
-			log.SetOutput(os.Stdout)
+		if err := startPlugin(p); err != nil {
 			return plugins, true, nil
 		}
 		started++
@@ -275,52 +483,125 @@ func startPlugins(c *cli.Context, flags []cli.Flag, restarting bool) ([]*NvidiaD
 	return plugins, false, nil
 }
 
-func stopPlugins(plugins []*NvidiaDevicePlugin) error {
-	log.Println("Stopping plugins.")
+// newPlugins builds the set of plugins serving the resources described by 'config'.
+// The plugins are not started.
+func newPlugins(c *cli.Context, config *spec.Config) ([]*NvidiaDevicePlugin, error) {
+	var fixture *fake.Fixture
+	if c.String("device-backend") == deviceBackendFake {
+		var err error
+		fixture, err = fake.LoadFixture(c.String("fake-device-fixture"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load fake device fixture: %v", err)
+		}
+	}
+
+	// Update the configuration file with default resources.
+	log.Println("Updating config with default resource matching patterns.")
+	var err error
+	if fixture != nil {
+		err = fixture.AddDefaultResourcesToConfig(config)
+	} else {
+		err = rm.AddDefaultResourcesToConfig(config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to add default resources to config: %v", err)
+	}
+
+	err = config.Sharing.ValidateRenames(config.Resources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sharing config: %v", err)
+	}
+
+	// Print the config to the output.
+	configJSON, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config to JSON: %v", err)
+	}
+	log.Printf("\nRunning with config:\n%v", string(configJSON))
+
+	// Get the set of plugins.
+	if fixture != nil {
+		log.Println("Retreiving plugins for simulated devices.")
+		rms, err := fixture.NewResourceManagers(config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load resource managers to manage simulated devices: %v", err)
+		}
+		return getPlugins(config, rms), nil
+	}
+
+	log.Println("Retreiving plugins.")
+	migStrategy, err := NewMigStrategy(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating MIG strategy: %v", err)
+	}
+	return migStrategy.GetPlugins(), nil
+}
+
+// startPlugin starts the gRPC server for plugin p and connects it with the kubelet.
+func startPlugin(p *NvidiaDevicePlugin) error {
+	err := p.Start()
+	if err != nil {
+		log.SetOutput(os.Stderr)
+		log.Println("Could not contact Kubelet. Did you enable the device plugin feature gate?")
+		log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
+		log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
+		log.SetOutput(os.Stdout)
+	}
+	return err
+}
+
+// writeNICPairingHints writes the RDMA NIC closest to each GPU served by 'plugins' to the NIC pairing hint file (if set).
+func writeNICPairingHints(c *cli.Context, plugins []*NvidiaDevicePlugin) error {
+	path := c.String("nic-pairing-hint-file")
+	if path == "" {
+		return nil
+	}
+
+	var gpus []pairing.GPU
+	seen := make(map[string]bool)
 	for _, p := range plugins {
-		p.Stop()
+		for _, d := range p.Devices() {
+			id := rm.AnnotatedID(d.ID).GetID()
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			gpus = append(gpus, pairing.GPU{ID: id, BusID: d.BusID})
+		}
 	}
-	log.Println("Shutting down NVML.")
-	if err := nvml.Shutdown(); err != nil {
-		return fmt.Errorf("error shutting down NVML: %v", err)
+
+	hints, err := pairing.Discover(pairing.DefaultSysfsRoot, gpus)
+	if err != nil {
+		return fmt.Errorf("error discovering NIC pairing: %v", err)
+	}
+	err = hints.Write(path)
+	if err != nil {
+		return fmt.Errorf("error writing NIC pairing hint file: %v", err)
 	}
+	log.Printf("Wrote %d GPU / NIC pairs to %s", len(hints.Pairs), path)
+
 	return nil
 }
 
-// disableResourceRenamingInConfig temporarily disable the resource renaming feature of the plugin.
-// We plan to reeenable this feature in a future release.
-func disableResourceRenamingInConfig(config *spec.Config) {
-	// Disable resource renaming through config.Resource
-	if len(config.Resources.GPUs) > 0 || len(config.Resources.MIGs) > 0 {
-		log.Printf("Customizing the 'resources' field is not yet supported in the config. Ignoring...")
-	}
-	config.Resources.GPUs = nil
-	config.Resources.MIGs = nil
-
-	// Disable renaming / device selection in Sharing.TimeSlicing.Resources
-	renameByDefault := config.Sharing.TimeSlicing.RenameByDefault
-	setsNonDefaultRename := false
-	setsDevices := false
-	for i, r := range config.Sharing.TimeSlicing.Resources {
-		if !renameByDefault && r.Rename != "" {
-			setsNonDefaultRename = true
-			config.Sharing.TimeSlicing.Resources[i].Rename = ""
-		}
-		if renameByDefault && r.Rename != r.Name.DefaultSharedRename() {
-			setsNonDefaultRename = true
-			config.Sharing.TimeSlicing.Resources[i].Rename = r.Name.DefaultSharedRename()
-		}
-		if !r.Devices.All {
-			setsDevices = true
-			config.Sharing.TimeSlicing.Resources[i].Devices.All = true
-			config.Sharing.TimeSlicing.Resources[i].Devices.Count = 0
-			config.Sharing.TimeSlicing.Resources[i].Devices.List = nil
-		}
+// newNodeLabeler returns a node.Labeler for the node the plugin is running on (nil if the node name is not set).
+func newNodeLabeler(c *cli.Context) (*node.Labeler, error) {
+	if c.String("node-name") == "" {
+		return nil, nil
 	}
-	if setsNonDefaultRename {
-		log.Printf("Setting the 'rename' field in sharing.timeSlicing.resources is not yet supported in the config. Ignoring...")
+	return node.NewLabeler(c.String("kubeconfig"), c.String("node-name"))
+}
+
+func stopPlugins(c *cli.Context, plugins []*NvidiaDevicePlugin) error {
+	log.Println("Stopping plugins.")
+	for _, p := range plugins {
+		p.Stop()
 	}
-	if setsDevices {
-		log.Printf("Customizing the 'devices' field in sharing.timeSlicing.resources is not yet supported in the config. Ignoring...")
+	if c.String("device-backend") == deviceBackendFake {
+		return nil
 	}
+	log.Println("Shutting down NVML.")
+	if err := nvml.Shutdown(); err != nil {
+		return fmt.Errorf("error shutting down NVML: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	cli "github.com/urfave/cli/v2"
+)
+
+// reloadPlugins reloads the config and restarts only those plugins whose resources are affected by the change.
+// Plugins serving unchanged resources keep running, so the kubelet never sees them go away.
+// The returned bool is set if all plugins need to be restarted instead (e.g. because a global option changed).
+// If the new config is invalid, the current plugins are left untouched and an error is returned.
+func reloadPlugins(c *cli.Context, flags []cli.Flag, current []*NvidiaDevicePlugin) ([]*NvidiaDevicePlugin, bool, error) {
+	log.Println("Reloading configuration.")
+	config, err := loadConfig(c, flags)
+	if err != nil {
+		return current, false, fmt.Errorf("unable to load config: %v", err)
+	}
+
+	if len(current) == 0 {
+		log.Println("No plugins running, restarting all plugins.")
+		return current, true, nil
+	}
+	if globalOptionsChanged(current[0].config, config) {
+		log.Println("Global options changed, restarting all plugins.")
+		return current, true, nil
+	}
+
+	candidates, err := newPlugins(c, config)
+	if err != nil {
+		return current, false, err
+	}
+
+	// Keep running plugins whose resources are unchanged and stop all others
+	// before starting their replacements, so they never compete for the same socket.
+	keep, stop, start := partitionPlugins(current, candidates)
+	plugins := append(keep, start...)
+	for _, p := range stop {
+		log.Printf("Resource '%s' changed, stopping its plugin.", p.rm.Resource())
+		if err := p.Stop(); err != nil {
+			log.Printf("Failed to stop plugin for resource '%s': %v", p.rm.Resource(), err)
+		}
+		for _, id := range rm.AnnotatedIDs(p.Devices().GetIDs()).GetIDs() {
+			p.nodeHealth.SetHealthy(id, true)
+			p.failures.DeviceRecovered(id)
+		}
+	}
+
+	restart := false
+	for _, p := range start {
+		p.nodeHealth = current[0].nodeHealth
+		p.failures = current[0].failures
+		p.sharingLabels = current[0].sharingLabels
+		p.audit = current[0].audit
+		if len(p.Devices()) == 0 {
+			continue
+		}
+		log.Printf("Resource '%s' changed, starting its plugin.", p.rm.Resource())
+		if err := startPlugin(p); err != nil {
+			restart = true
+		}
+	}
+
+	// Act on pods using devices that are no longer advertised (e.g. after MIG reconfiguration).
+	err = current[0].failures.Update(config, plugins)
+	if err != nil {
+		return plugins, restart, fmt.Errorf("error updating device failure handling: %v", err)
+	}
+
+	err = current[0].sharingLabels.Update(config, plugins)
+	if err != nil {
+		return plugins, restart, err
+	}
+
+	err = writeNICPairingHints(c, plugins)
+	if err != nil {
+		return plugins, restart, err
+	}
+
+	return plugins, restart, nil
+}
+
+// globalOptionsChanged checks whether any options that are not compared per resource by pluginKey differ between
+// 'old' and 'new'. Only the resources and sharing sections are compared per resource, so that any other
+// option (including ones added to the config later) restarts all plugins rather than being silently ignored.
+func globalOptionsChanged(old, new *spec.Config) bool {
+	global := func(c *spec.Config) spec.Config {
+		g := *c
+		g.Resources = spec.Resources{}
+		g.Sharing = spec.Sharing{}
+		return g
+	}
+	return !reflect.DeepEqual(global(old), global(new))
+}
+
+// partitionPlugins splits the plugins for a reloaded config into the currently running plugins to keep, those to
+// stop, and the candidate plugins to start in place of the stopped ones. A running plugin is kept if a candidate
+// serves the same resource with the same pluginKey; the candidate is then dropped.
+func partitionPlugins(current, candidates []*NvidiaDevicePlugin) (keep, stop, start []*NvidiaDevicePlugin) {
+	running := make(map[spec.ResourceName]*NvidiaDevicePlugin)
+	for _, p := range current {
+		running[p.rm.Resource()] = p
+	}
+
+	kept := make(map[*NvidiaDevicePlugin]bool)
+	for _, p := range candidates {
+		if r, exists := running[p.rm.Resource()]; exists && pluginKey(r) == pluginKey(p) {
+			keep = append(keep, r)
+			kept[r] = true
+			continue
+		}
+		start = append(start, p)
+	}
+	for _, p := range current {
+		if !kept[p] {
+			stop = append(stop, p)
+		}
+	}
+
+	return keep, stop, start
+}
+
+// pluginKey returns a key that changes whenever anything that affects how plugin p serves its resource changes.
+func pluginKey(p *NvidiaDevicePlugin) string {
+	ids := p.Devices().GetIDs()
+	sort.Strings(ids)
+
+	key := struct {
+		Resource                   spec.ResourceName
+		Devices                    []string
+		MPS                        *spec.ReplicatedResource
+		Fractional                 bool
+		FailRequestsGreaterThanOne bool
+	}{
+		Resource:                   p.rm.Resource(),
+		Devices:                    ids,
+		MPS:                        p.mps,
+		Fractional:                 p.fractional,
+		FailRequestsGreaterThanOne: p.config.Sharing.TimeSlicing.FailRequestsGreaterThanOne,
+	}
+
+	data, _ := json.Marshal(key)
+	return string(data)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// newReloadTestPlugin creates a plugin serving the devices with the given IDs as 'resource' under 'config'.
+func newReloadTestPlugin(config *spec.Config, resource spec.ResourceName, ids ...string) *NvidiaDevicePlugin {
+	r := &testResourceManager{resource: resource, devices: newTestDevices(ids...)}
+	return NewNvidiaDevicePlugin(config, r)
+}
+
+func TestPartitionPlugins(t *testing.T) {
+	config := newTestConfig(spec.DeviceListStrategyEnvvar)
+	gpu := newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1")
+	shared := newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1")
+
+	testCases := []struct {
+		description string
+		current     []*NvidiaDevicePlugin
+		candidates  []*NvidiaDevicePlugin
+		keep        []string
+		stop        []string
+		start       []string
+	}{
+		{
+			description: "unchanged",
+			current:     []*NvidiaDevicePlugin{gpu, shared},
+			candidates: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-1", "GPU-0"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1"),
+			},
+			keep: []string{"nvidia.com/gpu", "nvidia.com/gpu.shared"},
+		},
+		{
+			description: "replicas changed",
+			current:     []*NvidiaDevicePlugin{gpu, shared},
+			candidates: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.shared", "GPU-2::0", "GPU-2::1", "GPU-2::2"),
+			},
+			keep:  []string{"nvidia.com/gpu"},
+			stop:  []string{"nvidia.com/gpu.shared"},
+			start: []string{"nvidia.com/gpu.shared"},
+		},
+		{
+			description: "resource renamed",
+			current:     []*NvidiaDevicePlugin{gpu, shared},
+			candidates: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1"),
+				newReloadTestPlugin(config, "nvidia.com/gpu.timesliced", "GPU-2::0", "GPU-2::1"),
+			},
+			keep:  []string{"nvidia.com/gpu"},
+			stop:  []string{"nvidia.com/gpu.shared"},
+			start: []string{"nvidia.com/gpu.timesliced"},
+		},
+		{
+			description: "devices moved between resources",
+			current:     []*NvidiaDevicePlugin{gpu, shared},
+			candidates: []*NvidiaDevicePlugin{
+				newReloadTestPlugin(config, "nvidia.com/gpu", "GPU-0", "GPU-1", "GPU-2"),
+			},
+			stop:  []string{"nvidia.com/gpu", "nvidia.com/gpu.shared"},
+			start: []string{"nvidia.com/gpu"},
+		},
+	}
+
+	resources := func(plugins []*NvidiaDevicePlugin) []string {
+		var res []string
+		for _, p := range plugins {
+			res = append(res, string(p.rm.Resource()))
+		}
+		return res
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			keep, stop, start := partitionPlugins(tc.current, tc.candidates)
+
+			require.Equal(t, tc.keep, resources(keep))
+			require.Equal(t, tc.stop, resources(stop))
+			require.Equal(t, tc.start, resources(start))
+
+			// Kept plugins are the running ones, all others are new.
+			for _, p := range keep {
+				require.Contains(t, tc.current, p)
+			}
+			for _, p := range start {
+				require.Contains(t, tc.candidates, p)
+			}
+		})
+	}
+}
+
+func TestGlobalOptionsChanged(t *testing.T) {
+	testCases := []struct {
+		description string
+		update      func(c *spec.Config)
+		expected    bool
+	}{
+		{
+			description: "unchanged",
+			update:      func(c *spec.Config) {},
+			expected:    false,
+		},
+		{
+			description: "flags changed",
+			update: func(c *spec.Config) {
+				c.Flags.Plugin.DeviceListStrategy = ptr(spec.DeviceListStrategyCDIAnnotations)
+			},
+			expected: true,
+		},
+		{
+			description: "health changed",
+			update: func(c *spec.Config) {
+				c.Health.OnDeviceFailure = spec.OnDeviceFailureEvict
+			},
+			expected: true,
+		},
+		{
+			description: "sharing changed",
+			update: func(c *spec.Config) {
+				c.Sharing.TimeSlicing.Resources = []spec.ReplicatedResource{{Name: "nvidia.com/gpu", Replicas: 2}}
+			},
+			expected: false,
+		},
+		{
+			description: "resources changed",
+			update: func(c *spec.Config) {
+				c.Resources.GPUs = []spec.Resource{{Pattern: "*", Name: "nvidia.com/gpu"}}
+			},
+			expected: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			old := newTestConfig(spec.DeviceListStrategyEnvvar)
+			new := newTestConfig(spec.DeviceListStrategyEnvvar)
+			tc.update(new)
+
+			require.Equal(t, tc.expected, globalOptionsChanged(old, new))
+		})
+	}
+}
@@ -27,7 +27,11 @@ import (
 	"time"
 
 	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/audit"
+	"github.com/NVIDIA/k8s-device-plugin/internal/cdi"
+	"github.com/NVIDIA/k8s-device-plugin/internal/mps"
 	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	"github.com/google/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -39,39 +43,73 @@ const (
 	deviceListAsVolumeMountsContainerPathRoot = "/var/run/nvidia-container-devices"
 )
 
+// Constants for use by the 'cdi-annotations' device list strategy
+const (
+	cdiAnnotationPluginName = "nvidia-device-plugin"
+)
+
+// commonDevicePaths lists the device nodes required by all containers using NVIDIA devices
+var commonDevicePaths = []string{
+	"/dev/nvidiactl",
+	"/dev/nvidia-uvm",
+	"/dev/nvidia-uvm-tools",
+	"/dev/nvidia-modeset",
+}
+
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
 	rm               rm.ResourceManager
 	config           *spec.Config
 	deviceListEnvvar string
 	socket           string
-
-	server *grpc.Server
-	health chan *rm.Device
-	stop   chan interface{}
+	cdiSpecPath      string
+	mps              *spec.ReplicatedResource
+	mpsDaemons       map[string]*mps.Daemon
+	fractional       bool
+	nodeHealth       *nodeHealthLabeler
+	failures         *deviceFailureHandler
+	sharingLabels    *sharingLabeler
+	audit            *audit.Log
+
+	server    *grpc.Server
+	health    chan *rm.Device
+	recovered chan *rm.Device
+	stop      chan interface{}
 }
 
 // NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
 func NewNvidiaDevicePlugin(config *spec.Config, resourceManager rm.ResourceManager) *NvidiaDevicePlugin {
 	_, name := resourceManager.Resource().Split()
 
+	// Fractions of GPUs are shared through MPS, so they are served like MPS replicas.
+	mps := getMPSResource(config, resourceManager.Resource())
+	fractional := getFractionalResource(config, resourceManager.Resource())
+	if fractional != nil {
+		mps = fractional
+	}
+
 	return &NvidiaDevicePlugin{
 		rm:               resourceManager,
 		config:           config,
 		deviceListEnvvar: "NVIDIA_VISIBLE_DEVICES",
 		socket:           pluginapi.DevicePluginPath + "nvidia-" + name + ".sock",
+		cdiSpecPath:      cdi.SpecPath(cdi.DefaultSpecDir, name),
+		mps:              mps,
+		fractional:       fractional != nil,
 
 		// These will be reinitialized every
 		// time the plugin server is restarted.
-		server: nil,
-		health: nil,
-		stop:   nil,
+		server:    nil,
+		health:    nil,
+		recovered: nil,
+		stop:      nil,
 	}
 }
 
 func (plugin *NvidiaDevicePlugin) initialize() {
 	plugin.server = grpc.NewServer([]grpc.ServerOption{}...)
 	plugin.health = make(chan *rm.Device)
+	plugin.recovered = make(chan *rm.Device)
 	plugin.stop = make(chan interface{})
 }
 
@@ -79,6 +117,7 @@ func (plugin *NvidiaDevicePlugin) cleanup() {
 	close(plugin.stop)
 	plugin.server = nil
 	plugin.health = nil
+	plugin.recovered = nil
 	plugin.stop = nil
 }
 
@@ -92,9 +131,30 @@ func (plugin *NvidiaDevicePlugin) Devices() rm.Devices {
 func (plugin *NvidiaDevicePlugin) Start() error {
 	plugin.initialize()
 
+	if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyCDIAnnotations {
+		err := plugin.writeCDISpec()
+		if err != nil {
+			log.Printf("Could not write CDI spec for '%s': %s", plugin.rm.Resource(), err)
+			plugin.cleanup()
+			return err
+		}
+		log.Printf("Wrote CDI spec for '%s' to %s", plugin.rm.Resource(), plugin.cdiSpecPath)
+	}
+
+	if plugin.mps != nil {
+		err := plugin.startMPSDaemons()
+		if err != nil {
+			log.Printf("Could not start MPS control daemons for '%s': %s", plugin.rm.Resource(), err)
+			plugin.stopMPSDaemons()
+			plugin.cleanup()
+			return err
+		}
+	}
+
 	err := plugin.Serve()
 	if err != nil {
 		log.Printf("Could not start device plugin for '%s': %s", plugin.rm.Resource(), err)
+		plugin.stopMPSDaemons()
 		plugin.cleanup()
 		return err
 	}
@@ -108,7 +168,7 @@ func (plugin *NvidiaDevicePlugin) Start() error {
 	}
 	log.Printf("Registered device plugin for '%s' with Kubelet", plugin.rm.Resource())
 
-	go plugin.rm.CheckHealth(plugin.stop, plugin.health)
+	go plugin.rm.CheckHealth(plugin.stop, plugin.health, plugin.recovered)
 
 	return nil
 }
@@ -120,9 +180,15 @@ func (plugin *NvidiaDevicePlugin) Stop() error {
 	}
 	log.Printf("Stopping to serve '%s' on %s", plugin.rm.Resource(), plugin.socket)
 	plugin.server.Stop()
+	plugin.stopMPSDaemons()
 	if err := os.Remove(plugin.socket); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyCDIAnnotations {
+		if err := os.Remove(plugin.cdiSpecPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	plugin.cleanup()
 	return nil
 }
@@ -219,9 +285,16 @@ func (plugin *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.D
 		case <-plugin.stop:
 			return nil
 		case d := <-plugin.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
 			d.Health = pluginapi.Unhealthy
 			log.Printf("'%s' device marked unhealthy: %s", plugin.rm.Resource(), d.ID)
+			plugin.nodeHealth.SetHealthy(rm.AnnotatedID(d.ID).GetID(), false)
+			plugin.failures.DeviceFailed(plugin.rm.Resource(), rm.AnnotatedID(d.ID).GetID())
+			s.Send(&pluginapi.ListAndWatchResponse{Devices: plugin.apiDevices()})
+		case d := <-plugin.recovered:
+			d.Health = pluginapi.Healthy
+			log.Printf("'%s' device marked healthy: %s", plugin.rm.Resource(), d.ID)
+			plugin.nodeHealth.SetHealthy(rm.AnnotatedID(d.ID).GetID(), true)
+			plugin.failures.DeviceRecovered(rm.AnnotatedID(d.ID).GetID())
 			s.Send(&pluginapi.ListAndWatchResponse{Devices: plugin.apiDevices()})
 		}
 	}
@@ -231,10 +304,23 @@ func (plugin *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.D
 func (plugin *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
 	response := &pluginapi.PreferredAllocationResponse{}
 	for _, req := range r.ContainerRequests {
-		devices, err := plugin.rm.GetPreferredAllocation(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		devices, decision, err := plugin.rm.ExplainPreferredAllocation(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+
+		entry := audit.Entry{
+			Call:      audit.CallGetPreferredAllocation,
+			Resource:  string(plugin.rm.Resource()),
+			Available: req.AvailableDeviceIDs,
+			Required:  req.MustIncludeDeviceIDs,
+			Size:      int(req.AllocationSize),
+			Decision:  decision,
+			Devices:   devices,
+		}
 		if err != nil {
+			entry.Error = err.Error()
+			plugin.audit.Record(entry)
 			return nil, fmt.Errorf("error getting list of preferred allocation devices: %v", err)
 		}
+		plugin.audit.Record(entry)
 
 		resp := &pluginapi.ContainerPreferredAllocationResponse{
 			DeviceIDs: devices,
@@ -249,40 +335,90 @@ func (plugin *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r
 func (plugin *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range reqs.ContainerRequests {
-		// If the devices being allocated are replicas, then (conditionally)
-		// error out if more than one resource is being allocated.
-		if plugin.config.Sharing.TimeSlicing.FailRequestsGreaterThanOne && rm.AnnotatedIDs(req.DevicesIDs).AnyHasAnnotations() {
-			if len(req.DevicesIDs) > 1 {
-				return nil, fmt.Errorf("request for '%v: %v' too large: maximum request size for shared resources is 1", plugin.rm.Resource(), len(req.DevicesIDs))
-			}
+		response, err := plugin.allocateContainer(req)
+
+		entry := audit.Entry{
+			Call:     audit.CallAllocate,
+			Resource: string(plugin.rm.Resource()),
+			Devices:  req.DevicesIDs,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+			plugin.audit.Record(entry)
+			return nil, err
 		}
+		entry.Envs = response.Envs
+		entry.Mounts = response.Mounts
+		entry.DeviceSpecs = response.Devices
+		entry.Annotations = response.Annotations
+		plugin.audit.Record(entry)
 
-		for _, id := range req.DevicesIDs {
-			if !plugin.rm.Devices().Contains(id) {
-				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", plugin.rm.Resource(), id)
-			}
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	plugin.sharingLabels.Refresh()
+
+	return &responses, nil
+}
+
+// allocateContainer builds the response to the allocation request of a single container.
+func (plugin *NvidiaDevicePlugin) allocateContainer(req *pluginapi.ContainerAllocateRequest) (*pluginapi.ContainerAllocateResponse, error) {
+	// If the devices being allocated are replicas, then (conditionally)
+	// error out if more than one resource is being allocated.
+	if plugin.config.Sharing.TimeSlicing.FailRequestsGreaterThanOne && !plugin.fractional && rm.AnnotatedIDs(req.DevicesIDs).AnyHasAnnotations() {
+		if len(req.DevicesIDs) > 1 {
+			return nil, fmt.Errorf("request for '%v: %v' too large: maximum request size for shared resources is 1", plugin.rm.Resource(), len(req.DevicesIDs))
 		}
+	}
 
-		response := pluginapi.ContainerAllocateResponse{}
+	// Replicas shared through MPS are always limited to one per container.
+	if plugin.mps != nil && !plugin.fractional && len(req.DevicesIDs) > 1 {
+		return nil, fmt.Errorf("request for '%v: %v' too large: maximum request size for MPS shared resources is 1", plugin.rm.Resource(), len(req.DevicesIDs))
+	}
 
-		ids := req.DevicesIDs
-		deviceIDs := plugin.deviceIDsFromAnnotatedDeviceIDs(ids)
+	// Fractions allocated to a container must all come from the same GPU.
+	if plugin.fractional && !isSingleDevice(req.DevicesIDs) {
+		return nil, fmt.Errorf("invalid allocation request for '%v: %v': fractions span more than one GPU", plugin.rm.Resource(), len(req.DevicesIDs))
+	}
 
-		if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyEnvvar {
-			response.Envs = plugin.apiEnvs(plugin.deviceListEnvvar, deviceIDs)
+	for _, id := range req.DevicesIDs {
+		if !plugin.rm.Devices().Contains(id) {
+			return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", plugin.rm.Resource(), id)
 		}
-		if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyVolumeMounts {
-			response.Envs = plugin.apiEnvs(plugin.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot})
-			response.Mounts = plugin.apiMounts(deviceIDs)
+	}
+
+	response := pluginapi.ContainerAllocateResponse{}
+
+	ids := req.DevicesIDs
+	// All fractions refer to the same GPU, so a single one is enough to expose it to the container.
+	if plugin.fractional && len(ids) > 0 {
+		ids = ids[:1]
+	}
+	deviceIDs := plugin.deviceIDsFromAnnotatedDeviceIDs(ids)
+
+	if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyEnvvar {
+		response.Envs = plugin.apiEnvs(plugin.deviceListEnvvar, deviceIDs)
+	}
+	if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyVolumeMounts {
+		response.Envs = plugin.apiEnvs(plugin.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot})
+		response.Mounts = plugin.apiMounts(deviceIDs)
+	}
+	if *plugin.config.Flags.Plugin.DeviceListStrategy == spec.DeviceListStrategyCDIAnnotations {
+		response.Annotations = cdi.Annotations(cdiAnnotationPluginName, uuid.New().String(), deviceIDs)
+	}
+	if *plugin.config.Flags.Plugin.PassDeviceSpecs {
+		response.Devices = plugin.apiDeviceSpecs(*plugin.config.Flags.NvidiaDriverRoot, ids)
+	}
+	if plugin.mps != nil {
+		if response.Envs == nil {
+			response.Envs = make(map[string]string)
 		}
-		if *plugin.config.Flags.Plugin.PassDeviceSpecs {
-			response.Devices = plugin.apiDeviceSpecs(*plugin.config.Flags.NvidiaDriverRoot, ids)
+		for k, v := range plugin.apiMPSEnvs(req.DevicesIDs) {
+			response.Envs[k] = v
 		}
-
-		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		response.Mounts = append(response.Mounts, plugin.apiMPSMounts(ids)...)
 	}
 
-	return &responses, nil
+	return &response, nil
 }
 
 // PreStartContainer is unimplemented for this plugin
@@ -344,22 +480,13 @@ func (plugin *NvidiaDevicePlugin) apiMounts(deviceIDs []string) []*pluginapi.Mou
 func (plugin *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, ids []string) []*pluginapi.DeviceSpec {
 	var specs []*pluginapi.DeviceSpec
 
-	paths := []string{
-		"/dev/nvidiactl",
-		"/dev/nvidia-uvm",
-		"/dev/nvidia-uvm-tools",
-		"/dev/nvidia-modeset",
-	}
-
-	for _, p := range paths {
-		if _, err := os.Stat(p); err == nil {
-			spec := &pluginapi.DeviceSpec{
-				ContainerPath: p,
-				HostPath:      filepath.Join(driverRoot, p),
-				Permissions:   "rw",
-			}
-			specs = append(specs, spec)
+	for _, p := range existingCommonDevicePaths() {
+		spec := &pluginapi.DeviceSpec{
+			ContainerPath: p,
+			HostPath:      filepath.Join(driverRoot, p),
+			Permissions:   "rw",
 		}
+		specs = append(specs, spec)
 	}
 
 	for _, p := range plugin.rm.Devices().Subset(ids).GetPaths() {
@@ -373,3 +500,143 @@ func (plugin *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, ids []string
 
 	return specs
 }
+
+// writeCDISpec generates a CDI spec for all devices managed by the plugin and writes it to disk.
+// Replicas of the same device map onto a single entry in the spec.
+// The driver files put in the spec are looked up under the container driver root, which defaults to the driver root.
+func (plugin *NvidiaDevicePlugin) writeCDISpec() error {
+	devices := make(map[string][]string)
+	for _, d := range plugin.rm.Devices() {
+		name := plugin.deviceIDsFromAnnotatedDeviceIDs([]string{d.ID})[0]
+		devices[name] = d.Paths
+	}
+
+	driverRoot := *plugin.config.Flags.NvidiaDriverRoot
+	containerDriverRoot := driverRoot
+	if root := plugin.config.Flags.Plugin.ContainerDriverRoot; root != nil && *root != "" {
+		containerDriverRoot = *root
+	}
+	nvidiaCTKPath := cdi.DefaultNvidiaCTKPath
+	if path := plugin.config.Flags.Plugin.NvidiaCTKPath; path != nil && *path != "" {
+		nvidiaCTKPath = *path
+	}
+
+	driver, err := cdi.DiscoverDriver(containerDriverRoot, nvidiaCTKPath)
+	if err != nil {
+		return fmt.Errorf("error discovering driver files: %v", err)
+	}
+
+	return cdi.NewSpec(driverRoot, devices, existingCommonDevicePaths(), driver).Write(plugin.cdiSpecPath)
+}
+
+// existingCommonDevicePaths returns the subset of commonDevicePaths present on the system.
+func existingCommonDevicePaths() []string {
+	var paths []string
+	for _, p := range commonDevicePaths {
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// getMPSResource returns the MPS shared resource advertised under 'resource' (nil if there is none).
+func getMPSResource(config *spec.Config, resource spec.ResourceName) *spec.ReplicatedResource {
+	for _, r := range config.Sharing.MPSResources() {
+		name := r.Name
+		if r.Rename != "" {
+			name = r.Rename
+		}
+		if name == resource {
+			return &r
+		}
+	}
+	return nil
+}
+
+// getFractionalResource returns the resource advertised in fractions under 'resource' (nil if there is none).
+func getFractionalResource(config *spec.Config, resource spec.ResourceName) *spec.ReplicatedResource {
+	for _, r := range config.Sharing.FractionalResources() {
+		if r.Rename == resource {
+			return &r
+		}
+	}
+	return nil
+}
+
+// isSingleDevice checks if all annotated IDs refer to the same underlying device.
+func isSingleDevice(ids []string) bool {
+	for _, id := range rm.AnnotatedIDs(ids).GetIDs() {
+		if id != rm.AnnotatedID(ids[0]).GetID() {
+			return false
+		}
+	}
+	return true
+}
+
+// startMPSDaemons starts an MPS control daemon for each device underlying the replicas served by the plugin.
+func (plugin *NvidiaDevicePlugin) startMPSDaemons() error {
+	plugin.mpsDaemons = make(map[string]*mps.Daemon)
+	for _, d := range plugin.rm.Devices() {
+		id := rm.AnnotatedID(d.ID).GetID()
+		if _, exists := plugin.mpsDaemons[id]; exists {
+			continue
+		}
+		daemon := mps.NewDaemon(mps.DefaultRoot, *plugin.config.Flags.NvidiaDriverRoot, id)
+		plugin.mpsDaemons[id] = daemon
+		err := daemon.Start()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopMPSDaemons stops all MPS control daemons started by the plugin.
+func (plugin *NvidiaDevicePlugin) stopMPSDaemons() {
+	for id, daemon := range plugin.mpsDaemons {
+		if err := daemon.Stop(); err != nil {
+			log.Printf("Failed to stop MPS control daemon for %s: %v", id, err)
+		}
+	}
+	plugin.mpsDaemons = nil
+}
+
+func (plugin *NvidiaDevicePlugin) apiMPSEnvs(ids []string) map[string]string {
+	percentage := plugin.mps.ActiveThreadPercentage()
+	if plugin.fractional {
+		percentage = len(ids) * 100 / spec.FractionsPerGPU
+	}
+	return map[string]string{
+		mps.PipeDirectoryEnvvar:          mps.ContainerPipeDirectory,
+		mps.LogDirectoryEnvvar:           mps.ContainerLogDirectory,
+		mps.ActiveThreadPercentageEnvvar: fmt.Sprintf("%d", percentage),
+	}
+}
+
+func (plugin *NvidiaDevicePlugin) apiMPSMounts(ids []string) []*pluginapi.Mount {
+	var mounts []*pluginapi.Mount
+
+	for _, id := range rm.AnnotatedIDs(ids).GetIDs() {
+		daemon := plugin.mpsDaemons[id]
+		if daemon == nil {
+			continue
+		}
+		mounts = append(mounts,
+			&pluginapi.Mount{
+				HostPath:      daemon.PipeDir(),
+				ContainerPath: mps.ContainerPipeDirectory,
+			},
+			&pluginapi.Mount{
+				HostPath:      daemon.LogDir(),
+				ContainerPath: mps.ContainerLogDirectory,
+			},
+			&pluginapi.Mount{
+				HostPath:      daemon.ShmDir(),
+				ContainerPath: mps.ContainerShmDirectory,
+			},
+		)
+	}
+
+	return mounts
+}
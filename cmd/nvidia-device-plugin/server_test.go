@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/audit"
+	"github.com/NVIDIA/k8s-device-plugin/internal/cdi"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// testResourceManager is a rm.ResourceManager serving a fixed set of devices.
+type testResourceManager struct {
+	resource spec.ResourceName
+	devices  rm.Devices
+}
+
+func (r *testResourceManager) Resource() spec.ResourceName { return r.resource }
+func (r *testResourceManager) Devices() rm.Devices         { return r.devices }
+
+func (r *testResourceManager) GetPreferredAllocation(available, required []string, size int) ([]string, error) {
+	return available[:size], nil
+}
+
+func (r *testResourceManager) ExplainPreferredAllocation(available, required []string, size int) ([]string, *rm.AllocationDecision, error) {
+	return available[:size], &rm.AllocationDecision{Strategy: rm.AllocationStrategyStandard}, nil
+}
+
+func (r *testResourceManager) CheckHealth(stop <-chan interface{}, unhealthy chan<- *rm.Device, healthy chan<- *rm.Device) error {
+	return nil
+}
+
+// newTestDevices returns full GPUs with the given IDs, using /dev/nvidia<n> as the device node of GPU-<n>.
+func newTestDevices(ids ...string) rm.Devices {
+	devices := make(rm.Devices)
+	for _, id := range ids {
+		d := &rm.Device{}
+		d.ID = id
+		d.Index = strings.TrimPrefix(id, "GPU-")
+		d.Paths = []string{"/dev/nvidia" + d.Index}
+		d.Health = pluginapi.Healthy
+		devices[id] = d
+	}
+	return devices
+}
+
+// newTestConfig returns a config serving full GPUs by UUID with the given device list strategy.
+func newTestConfig(strategy string) *spec.Config {
+	return &spec.Config{
+		Version: spec.Version,
+		Flags: spec.Flags{
+			CommandLineFlags: spec.CommandLineFlags{
+				MigStrategy:      ptr(spec.MigStrategyNone),
+				NvidiaDriverRoot: ptr("/"),
+				Plugin: &spec.PluginCommandLineFlags{
+					PassDeviceSpecs:    ptr(false),
+					DeviceListStrategy: ptr(strategy),
+					DeviceIDStrategy:   ptr(spec.DeviceIDStrategyUUID),
+				},
+			},
+		},
+	}
+}
+
+// newTestPlugin creates a plugin serving 'devices' as nvidia.com/gpu with the given device list strategy.
+func newTestPlugin(t *testing.T, strategy string, devices rm.Devices) *NvidiaDevicePlugin {
+	r := &testResourceManager{resource: "nvidia.com/gpu", devices: devices}
+	config := newTestConfig(strategy)
+	config.Flags.Plugin.ContainerDriverRoot = ptr(newTestDriverRoot(t))
+	plugin := NewNvidiaDevicePlugin(config, r)
+	plugin.cdiSpecPath = cdi.SpecPath(t.TempDir(), "gpu")
+	return plugin
+}
+
+// newTestDriverRoot creates a minimal driver installation (a single library) under a temporary root.
+func newTestDriverRoot(t *testing.T) string {
+	root := t.TempDir()
+	dir := filepath.Join(root, "usr", "lib64")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "libcuda.so.520.61.05"), nil, 0755))
+	return root
+}
+
+func ptr[T any](x T) *T {
+	return &x
+}
+
+func TestAllocateCDIAnnotations(t *testing.T) {
+	plugin := newTestPlugin(t, spec.DeviceListStrategyCDIAnnotations, newTestDevices("GPU-0", "GPU-1"))
+	require.NoError(t, plugin.writeCDISpec())
+
+	reqs := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-1"}},
+		},
+	}
+	resp, err := plugin.Allocate(context.TODO(), reqs)
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	container := resp.ContainerResponses[0]
+
+	// The devices are requested through a single CDI annotation...
+	require.Len(t, container.Annotations, 1)
+	for key, value := range container.Annotations {
+		require.True(t, strings.HasPrefix(key, cdi.AnnotationPrefix+cdiAnnotationPluginName+"_"))
+		require.Equal(t, cdi.QualifiedName("GPU-1"), value)
+	}
+	// ...without relying on the NVIDIA runtime hook to inject them or the driver.
+	require.Empty(t, container.Envs)
+
+	data, err := os.ReadFile(plugin.cdiSpecPath)
+	require.NoError(t, err)
+	var written cdi.Spec
+	require.NoError(t, yaml.Unmarshal(data, &written))
+
+	require.Equal(t, cdi.Kind, written.Kind)
+	require.Empty(t, written.ContainerEdits.Env)
+	require.Equal(t, []*cdi.Mount{{HostPath: "/usr/lib64/libcuda.so.520.61.05", ContainerPath: "/usr/lib64/libcuda.so.520.61.05", Options: []string{"ro", "nosuid", "nodev", "bind"}}}, written.ContainerEdits.Mounts)
+	require.NotEmpty(t, written.ContainerEdits.Hooks)
+	require.Len(t, written.Devices, 2)
+	require.Equal(t, "GPU-1", written.Devices[1].Name)
+	require.Equal(t, []*cdi.DeviceNode{{Path: "/dev/nvidia1", HostPath: filepath.Join("/", "/dev/nvidia1")}}, written.Devices[1].ContainerEdits.DeviceNodes)
+}
+
+func TestAllocateAudit(t *testing.T) {
+	plugin := newTestPlugin(t, spec.DeviceListStrategyCDIAnnotations, newTestDevices("GPU-0", "GPU-1"))
+	plugin.config.Flags.Plugin.PassDeviceSpecs = ptr(true)
+	require.NoError(t, plugin.writeCDISpec())
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(path, 0)
+	require.NoError(t, err)
+	plugin.audit = auditLog
+
+	reqs := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-1"}},
+		},
+	}
+	resp, err := plugin.Allocate(context.TODO(), reqs)
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Close())
+	container := resp.ContainerResponses[0]
+	require.NotEmpty(t, container.Devices)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal(data, &entry))
+
+	require.Equal(t, audit.CallAllocate, entry.Call)
+	require.Equal(t, []string{"GPU-1"}, entry.Devices)
+	require.Equal(t, container.Envs, entry.Envs)
+	require.Equal(t, container.Mounts, entry.Mounts)
+	require.Equal(t, container.Devices, entry.DeviceSpecs)
+	require.Equal(t, container.Annotations, entry.Annotations)
+}
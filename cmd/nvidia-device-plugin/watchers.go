@@ -1,9 +1,12 @@
 package main
 
 import (
-	"github.com/fsnotify/fsnotify"
+	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 func newFSWatcher(files ...string) (*fsnotify.Watcher, error) {
@@ -29,3 +32,120 @@ func newOSWatcher(sigs ...os.Signal) chan os.Signal {
 
 	return sigChan
 }
+
+// configFileWatcher watches a config file that may be reached through symlinks.
+// The files of a mounted ConfigMap are symlinks into a '..data' directory that is itself a symlink swapped on every
+// update, and the config file may be a further symlink to such a file. The directories of every link leading to the
+// file and of the file itself are watched, and they are re-resolved whenever one of the links changes.
+type configFileWatcher struct {
+	*fsnotify.Watcher
+	path string
+	// target is the config file with all symlinks resolved ("" if it could not be resolved)
+	target string
+	// links holds 'path' and every link traversed to reach 'target'
+	links map[string]bool
+	// dirs holds the directories being watched
+	dirs map[string]bool
+}
+
+// newConfigFileWatcher returns a watcher for the config file at 'path'.
+func newConfigFileWatcher(path string) (*configFileWatcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path of '%v': %v", path, err)
+	}
+
+	watcher, err := newFSWatcher(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	w := &configFileWatcher{
+		Watcher: watcher,
+		path:    path,
+		dirs:    map[string]bool{filepath.Dir(path): true},
+	}
+	w.resolve()
+
+	return w, nil
+}
+
+// IsConfigFileEvent checks whether 'event' affects the config file.
+// This is the case for events on the file itself, on any of the links leading to it, or on a '..data' symlink next to
+// them. The links are re-resolved after each such event, since it may have changed where they lead.
+func (w *configFileWatcher) IsConfigFileEvent(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
+	if !w.links[name] && name != w.target && filepath.Base(name) != "..data" {
+		return false
+	}
+	w.resolve()
+	return true
+}
+
+// resolve follows the symlinks from the config file to its target and watches the directories along the way.
+// Directories that are no longer needed are unwatched. If the links cannot be followed (e.g. in the middle of an
+// update), the directories resolved so far are watched in addition to the ones already watched.
+func (w *configFileWatcher) resolve() {
+	links, err := symlinkChain(w.path)
+	if err == nil {
+		w.target, err = filepath.EvalSymlinks(w.path)
+	}
+
+	dirs := make(map[string]bool)
+	for link := range links {
+		dirs[filepath.Dir(link)] = true
+	}
+	if err == nil {
+		dirs[filepath.Dir(w.target)] = true
+	} else {
+		w.target = ""
+		for dir := range w.dirs {
+			dirs[dir] = true
+		}
+	}
+
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			delete(dirs, dir)
+		}
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			// The directory may have been removed, in which case it is no longer watched anyway.
+			_ = w.Remove(dir)
+		}
+	}
+
+	w.links = links
+	w.dirs = dirs
+}
+
+// symlinkChain returns 'path' and the paths of all symlinks followed when opening it, in order.
+// The paths traversed before an error is encountered are returned along with the error.
+func symlinkChain(path string) (map[string]bool, error) {
+	links := make(map[string]bool)
+	for i := 0; i < 255; i++ {
+		links[path] = true
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return links, err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return links, nil
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return links, err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+	}
+	return links, fmt.Errorf("too many levels of symbolic links")
+}
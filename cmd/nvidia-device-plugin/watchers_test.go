@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConfigMapDir creates a directory laid out like a mounted ConfigMap, with 'config.yaml' linking into the
+// timestamped directory 'version' through the '..data' symlink.
+func newTestConfigMapDir(t *testing.T, dir string, version string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, version), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, version, "config.yaml"), []byte("version: v1\n"), 0644))
+	require.NoError(t, os.Symlink(version, filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")))
+}
+
+// swapTestConfigMapDir updates a directory created by newTestConfigMapDir the way the kubelet does, by atomically
+// swapping the '..data' symlink to a new timestamped directory and removing the old one.
+func swapTestConfigMapDir(t *testing.T, dir string, from, to string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, to), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, to, "config.yaml"), []byte("version: v1\n"), 0644))
+	require.NoError(t, os.Symlink(to, filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, from)))
+}
+
+// requireConfigFileEvent waits for the watcher to report an event affecting the config file.
+func requireConfigFileEvent(t *testing.T, w *configFileWatcher) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-w.Events:
+			if w.IsConfigFileEvent(event) {
+				return
+			}
+		case err := <-w.Errors:
+			require.NoError(t, err)
+		case <-timeout:
+			require.Fail(t, "no config file event received")
+		}
+	}
+}
+
+// drainEvents consumes all pending events, returning whether any of them affected the config file.
+func drainEvents(w *configFileWatcher) bool {
+	var affected bool
+	for {
+		select {
+		case event := <-w.Events:
+			if w.IsConfigFileEvent(event) {
+				affected = true
+			}
+		case <-time.After(100 * time.Millisecond):
+			return affected
+		}
+	}
+}
+
+func TestConfigFileWatcher(t *testing.T) {
+	root := t.TempDir()
+	available := filepath.Join(root, "available")
+	config := filepath.Join(root, "config")
+
+	// The config file links to a file of a ConfigMap mounted in another directory.
+	newTestConfigMapDir(t, available, "..2022_01_01_00_00_00.0")
+	require.NoError(t, os.MkdirAll(config, 0755))
+	require.NoError(t, os.Symlink(filepath.Join(available, "config.yaml"), filepath.Join(config, "config.yaml")))
+
+	w, err := newConfigFileWatcher(filepath.Join(config, "config.yaml"))
+	require.NoError(t, err)
+	defer w.Close()
+
+	t.Run("swapping the ConfigMap behind the symlink", func(t *testing.T) {
+		swapTestConfigMapDir(t, available, "..2022_01_01_00_00_00.0", "..2022_01_02_00_00_00.0")
+		requireConfigFileEvent(t, w)
+		drainEvents(w)
+	})
+
+	t.Run("swapping the ConfigMap again", func(t *testing.T) {
+		swapTestConfigMapDir(t, available, "..2022_01_02_00_00_00.0", "..2022_01_03_00_00_00.0")
+		requireConfigFileEvent(t, w)
+		drainEvents(w)
+	})
+
+	t.Run("unrelated files are ignored", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(available, "other.yaml"), nil, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(config, "other.yaml"), nil, 0644))
+		require.False(t, drainEvents(w))
+	})
+
+	t.Run("re-pointing the symlink", func(t *testing.T) {
+		other := filepath.Join(root, "other")
+		newTestConfigMapDir(t, other, "..2022_01_01_00_00_00.0")
+		require.NoError(t, os.Symlink(filepath.Join(other, "config.yaml"), filepath.Join(config, "config.yaml.tmp")))
+		require.NoError(t, os.Rename(filepath.Join(config, "config.yaml.tmp"), filepath.Join(config, "config.yaml")))
+		requireConfigFileEvent(t, w)
+		drainEvents(w)
+
+		// Only the ConfigMap the symlink now points to is followed.
+		swapTestConfigMapDir(t, available, "..2022_01_03_00_00_00.0", "..2022_01_04_00_00_00.0")
+		require.False(t, drainEvents(w))
+
+		swapTestConfigMapDir(t, other, "..2022_01_01_00_00_00.0", "..2022_01_02_00_00_00.0")
+		requireConfigFileEvent(t, w)
+	})
+}
@@ -80,7 +80,7 @@ Security context for the plugin
 {{- define "nvidia-device-plugin.securityContext" -}}
 {{- if ne (len .Values.securityContext) 0 -}}
   {{ toYaml .Values.securityContext }}
-{{- else if .Values.compatWithCPUManager -}}
+{{- else if or .Values.compatWithCPUManager .Values.mps.enabled -}}
   privileged: true
 {{- else if ne (include "nvidia-device-plugin.allPossibleMigStrategiesAreNone" .) "true" -}}
     capabilities:
@@ -206,3 +206,38 @@ Pod annotations for the plugin and GFD
 {{- end -}}
 {{- toYaml $annotations }}
 {{- end -}}
+
+{{/*
+Check if the plugin needs access to the API server (and thus a service account),
+either to run the config manager or to label its node.
+*/}}
+{{- define "nvidia-device-plugin.hasServiceAccount" -}}
+{{- if or (eq (include "nvidia-device-plugin.hasConfigMap" .) "true") (eq (toString .Values.sharingNodeLabels) "true") -}}
+{{- true -}}
+{{- else -}}
+{{- false -}}
+{{- end -}}
+{{- end }}
+
+{{/*
+Check if the kubelet pod-resources socket is mounted into the plugin.
+*/}}
+{{- define "nvidia-device-plugin.hasPodResources" -}}
+{{- if or .Values.podResources.enabled (eq (toString .Values.sharingNodeLabels) "true") -}}
+{{- true -}}
+{{- else -}}
+{{- false -}}
+{{- end -}}
+{{- end }}
+
+{{/*
+Get the host directory to mount for the NIC pairing hint file ("" if none is needed).
+*/}}
+{{- define "nvidia-device-plugin.nicPairingHostDir" -}}
+{{- if .Values.nicPairing.enabled -}}
+{{- $dir := dir .Values.nicPairing.hintFile -}}
+{{- if and (ne $dir "/var/lib/kubelet/device-plugins") (not (hasPrefix "/var/lib/kubelet/device-plugins/" $dir)) -}}
+{{- $dir -}}
+{{- end -}}
+{{- end -}}
+{{- end }}
@@ -3,27 +3,28 @@ module github.com/NVIDIA/k8s-device-plugin
 go 1.18
 
 replace (
-	k8s.io/api => k8s.io/api v0.19.1
-	k8s.io/apiextensions-apiserver => k8s.io/apiextensions-apiserver v0.19.1
-	k8s.io/apimachinery => k8s.io/apimachinery v0.19.1
-	k8s.io/apiserver => k8s.io/apiserver v0.19.1
-	k8s.io/cli-runtime => k8s.io/cli-runtime v0.19.1
-	k8s.io/client-go => k8s.io/client-go v0.19.1
-	k8s.io/cloud-provider => k8s.io/cloud-provider v0.19.1
-	k8s.io/cluster-bootstrap => k8s.io/cluster-bootstrap v0.19.1
-	k8s.io/code-generator => k8s.io/code-generator v0.19.1
-	k8s.io/component-base => k8s.io/component-base v0.19.1
-	k8s.io/cri-api => k8s.io/cri-api v0.19.1
-	k8s.io/csi-translation-lib => k8s.io/csi-translation-lib v0.19.1
-	k8s.io/kube-aggregator => k8s.io/kube-aggregator v0.19.1
-	k8s.io/kube-controller-manager => k8s.io/kube-controller-manager v0.19.1
-	k8s.io/kube-proxy => k8s.io/kube-proxy v0.19.1
-	k8s.io/kube-scheduler => k8s.io/kube-scheduler v0.19.1
-	k8s.io/kubectl => k8s.io/kubectl v0.19.1
-	k8s.io/kubelet => k8s.io/kubelet v0.19.1
-	k8s.io/legacy-cloud-providers => k8s.io/legacy-cloud-providers v0.19.1
-	k8s.io/metrics => k8s.io/metrics v0.19.1
-	k8s.io/sample-apiserver => k8s.io/sample-apiserver v0.19.1
+	k8s.io/api => k8s.io/api v0.20.15
+	k8s.io/apiextensions-apiserver => k8s.io/apiextensions-apiserver v0.20.15
+	k8s.io/apimachinery => k8s.io/apimachinery v0.20.15
+	k8s.io/apiserver => k8s.io/apiserver v0.20.15
+	k8s.io/cli-runtime => k8s.io/cli-runtime v0.20.15
+	k8s.io/client-go => k8s.io/client-go v0.20.15
+	k8s.io/cloud-provider => k8s.io/cloud-provider v0.20.15
+	k8s.io/cluster-bootstrap => k8s.io/cluster-bootstrap v0.20.15
+	k8s.io/code-generator => k8s.io/code-generator v0.20.15
+	k8s.io/component-base => k8s.io/component-base v0.20.15
+	k8s.io/cri-api => k8s.io/cri-api v0.20.15
+	k8s.io/csi-translation-lib => k8s.io/csi-translation-lib v0.20.15
+	k8s.io/kube-aggregator => k8s.io/kube-aggregator v0.20.15
+	k8s.io/kube-controller-manager => k8s.io/kube-controller-manager v0.20.15
+	k8s.io/kube-proxy => k8s.io/kube-proxy v0.20.15
+	k8s.io/kube-scheduler => k8s.io/kube-scheduler v0.20.15
+	k8s.io/kubectl => k8s.io/kubectl v0.20.15
+	k8s.io/kubelet => k8s.io/kubelet v0.20.15
+	k8s.io/legacy-cloud-providers => k8s.io/legacy-cloud-providers v0.20.15
+	k8s.io/metrics => k8s.io/metrics v0.20.15
+	k8s.io/sample-apiserver => k8s.io/sample-apiserver v0.20.15
+	vbom.ml/util => github.com/fvbommel/util v0.0.0-20160121211510-db5cfe13f5cc
 )
 
 require (
@@ -31,16 +32,16 @@ require (
 	github.com/NVIDIA/go-nvml v0.11.6-0
 	github.com/NVIDIA/gpu-monitoring-tools v0.0.0-20201222072828-352eb4c503a7
 	github.com/fsnotify/fsnotify v1.4.9
-	github.com/google/uuid v1.1.1
-	github.com/prometheus/procfs v0.1.3
+	github.com/google/uuid v1.1.2
+	github.com/prometheus/procfs v0.2.0
 	github.com/sirupsen/logrus v1.6.0
-	github.com/stretchr/testify v1.5.1
+	github.com/stretchr/testify v1.6.1
 	github.com/urfave/cli/v2 v2.4.0
-	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	google.golang.org/grpc v1.29.0
-	k8s.io/api v0.19.1
-	k8s.io/apimachinery v0.19.1
-	k8s.io/client-go v0.19.1
+	k8s.io/api v0.20.15
+	k8s.io/apimachinery v0.20.15
+	k8s.io/client-go v0.20.15
 	k8s.io/kubelet v0.0.0
 	sigs.k8s.io/yaml v1.2.0
 )
@@ -48,10 +49,11 @@ require (
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/evanphx/json-patch v4.9.0+incompatible // indirect
 	github.com/go-logr/logr v0.2.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/golang/protobuf v1.4.2 // indirect
-	github.com/google/go-cmp v0.4.0 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/google/gofuzz v1.1.0 // indirect
 	github.com/googleapis/gnostic v0.4.1 // indirect
 	github.com/hashicorp/golang-lru v0.5.1 // indirect
@@ -60,20 +62,23 @@ require (
 	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
-	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6 // indirect
-	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f // indirect
-	golang.org/x/text v0.3.3 // indirect
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
+	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0 // indirect
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
+	golang.org/x/sys v0.0.0-20201112073958-5cba982894dd // indirect
+	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
 	google.golang.org/appengine v1.6.5 // indirect
-	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
-	google.golang.org/protobuf v1.24.0 // indirect
+	google.golang.org/genproto v0.0.0-20201110150050-8816d57aaa9a // indirect
+	google.golang.org/protobuf v1.25.0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
-	k8s.io/klog/v2 v2.2.0 // indirect
-	k8s.io/utils v0.0.0-20200729134348-d5654de09c73 // indirect
-	sigs.k8s.io/structured-merge-diff/v4 v4.0.1 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+	k8s.io/klog/v2 v2.4.0 // indirect
+	k8s.io/kube-openapi v0.0.0-20211110013926-83f114cd0513 // indirect
+	k8s.io/utils v0.0.0-20201110183641-67b214c5f920 // indirect
+	sigs.k8s.io/structured-merge-diff/v4 v4.1.2 // indirect
 )
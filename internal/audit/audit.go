@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Stdout is the path used to write the audit log to stdout instead of a file.
+const Stdout = "-"
+
+// StdoutPrefix is written in front of every entry written to stdout, to tell entries apart from the other output of the
+// plugin sharing the same stream.
+const StdoutPrefix = "audit: "
+
+// Constants representing the calls recorded in the audit log
+const (
+	CallGetPreferredAllocation = "GetPreferredAllocation"
+	CallAllocate               = "Allocate"
+)
+
+// Entry records a single allocation decision for one container.
+type Entry struct {
+	Time        time.Time               `json:"time"`
+	Call        string                  `json:"call"`
+	Resource    string                  `json:"resource"`
+	Available   []string                `json:"available,omitempty"`
+	Required    []string                `json:"required,omitempty"`
+	Size        int                     `json:"size,omitempty"`
+	Decision    *rm.AllocationDecision  `json:"decision,omitempty"`
+	Devices     []string                `json:"devices,omitempty"`
+	Envs        map[string]string       `json:"envs,omitempty"`
+	Mounts      []*pluginapi.Mount      `json:"mounts,omitempty"`
+	DeviceSpecs []*pluginapi.DeviceSpec `json:"deviceSpecs,omitempty"`
+	Annotations map[string]string       `json:"annotations,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// Log writes Entries as a stream of JSON objects, one per line.
+type Log struct {
+	sync.Mutex
+	w      io.WriteCloser
+	prefix string
+}
+
+// Open opens the audit log at 'path' for appending, or stdout if 'path' is Stdout, in which case each entry is prefixed
+// with StdoutPrefix. Once the file would grow beyond 'maxSize' bytes, it is moved to 'path'.1 (replacing any previous
+// one) and a new file is started, so that at most about twice 'maxSize' bytes are kept. If 'maxSize' is 0, the file
+// grows without bounds.
+func Open(path string, maxSize int64) (*Log, error) {
+	if path == Stdout {
+		return &Log{w: nopCloser{os.Stdout}, prefix: StdoutPrefix}, nil
+	}
+
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	err := f.open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &Log{w: f}, nil
+}
+
+// Record writes an entry to the audit log, setting its Time if unset.
+// Failures are logged rather than returned, so that they never affect the allocation being recorded.
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to marshal audit log entry: %v", err)
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	line := make([]byte, 0, len(l.prefix)+len(data)+1)
+	line = append(line, l.prefix...)
+	line = append(line, data...)
+	line = append(line, '\n')
+	_, err = l.w.Write(line)
+	if err != nil {
+		log.Printf("Failed to write audit log entry: %v", err)
+	}
+}
+
+// Close closes the audit log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.w.Close()
+}
+
+// rotatingFile is a file that is rotated once it would grow beyond maxSize bytes.
+// If a rotation fails, writes continue to go to the current file and the rotation is retried on the next write.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	// moved is set if the current file has already been moved to path.1 by a rotation that failed to open a new file
+	moved bool
+	// rotateErr is the error of the last failed rotation, logged only when it changes
+	rotateErr string
+}
+
+// open opens the file at f.path for appending.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to f.path.1 and opens a new one.
+// The current file is only closed once the new one is open, so that it can still be written to if the rotation fails.
+func (f *rotatingFile) rotate() error {
+	if !f.moved {
+		err := os.Rename(f.path, f.path+".1")
+		if err != nil {
+			return fmt.Errorf("error rotating audit log: %v", err)
+		}
+		f.moved = true
+	}
+
+	old := f.file
+	err := f.open()
+	if err != nil {
+		return fmt.Errorf("error reopening audit log: %v", err)
+	}
+	f.moved = false
+
+	err = old.Close()
+	if err != nil {
+		log.Printf("Failed to close rotated audit log: %v", err)
+	}
+	return nil
+}
+
+// Write appends data to the file, rotating it first if needed.
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		err := f.rotate()
+		switch {
+		case err != nil && err.Error() != f.rotateErr:
+			log.Printf("Failed to rotate audit log, writing to the current file until it succeeds: %v", err)
+			f.rotateErr = err.Error()
+		case err == nil && f.rotateErr != "":
+			log.Printf("Rotated audit log after previous failures")
+			f.rotateErr = ""
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// nopCloser wraps a writer that must not be closed (e.g. stdout).
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := Open(path, 0)
+	require.NoError(t, err)
+
+	entries := []Entry{
+		{
+			Call:      CallGetPreferredAllocation,
+			Resource:  "nvidia.com/gpu",
+			Available: []string{"GPU-0", "GPU-1"},
+			Size:      1,
+			Decision:  &rm.AllocationDecision{Strategy: rm.AllocationStrategyStandard, Reason: "devices include MIG devices"},
+			Devices:   []string{"GPU-0"},
+		},
+		{
+			Call:        CallAllocate,
+			Resource:    "nvidia.com/gpu",
+			Devices:     []string{"GPU-0"},
+			Envs:        map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-0"},
+			Mounts:      []*pluginapi.Mount{{ContainerPath: "/var/run/nvidia-device-plugin", HostPath: "/var/run/nvidia-device-plugin", ReadOnly: true}},
+			DeviceSpecs: []*pluginapi.DeviceSpec{{ContainerPath: "/dev/nvidia0", HostPath: "/dev/nvidia0", Permissions: "rw"}},
+			Annotations: map[string]string{"cdi.k8s.io/nvidia-device-plugin_GPU-0": "nvidia.com/gpu=GPU-0"},
+		},
+		{
+			Call:     CallAllocate,
+			Resource: "nvidia.com/gpu",
+			Required: []string{"GPU-2"},
+			Error:    "unknown device: GPU-2",
+		},
+	}
+	for _, e := range entries {
+		l.Record(e)
+	}
+	require.NoError(t, l.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var read []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		require.False(t, e.Time.IsZero())
+		e.Time = entries[len(read)].Time
+		read = append(read, e)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, entries, read)
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	entry := Entry{Call: CallAllocate, Resource: "nvidia.com/gpu", Devices: []string{"GPU-0"}}
+	data, err := json.Marshal(entry)
+	require.NoError(t, err)
+	size := int64(len(data) + 1)
+
+	// Room for two entries per file
+	l, err := Open(path, 2*size)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		entry.Time = time.Unix(int64(i), 0).UTC()
+		l.Record(entry)
+	}
+	require.NoError(t, l.Close())
+
+	testCases := []struct {
+		path     string
+		expected []int64
+	}{
+		{path + ".1", []int64{2, 3}},
+		{path, []int64{4}},
+	}
+	for _, tc := range testCases {
+		info, err := os.Stat(tc.path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		f, err := os.Open(tc.path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		var times []int64
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e Entry
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+			times = append(times, e.Time.Unix())
+		}
+		require.NoError(t, scanner.Err())
+		require.Equal(t, tc.expected, times, tc.path)
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	entry := Entry{Call: CallAllocate, Resource: "nvidia.com/gpu", Devices: []string{"GPU-0"}}
+	data, err := json.Marshal(entry)
+	require.NoError(t, err)
+	size := int64(len(data) + 1)
+
+	// A non-empty directory in place of the rotated file makes every rotation fail.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755))
+
+	l, err := Open(path, 2*size)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		entry.Time = time.Unix(int64(i), 0).UTC()
+		l.Record(entry)
+	}
+	require.Equal(t, []int64{0, 1, 2, 3}, readTimes(t, path), "entries are kept when the rotation fails")
+
+	// The rotation is retried on the next write once it can succeed.
+	require.NoError(t, os.RemoveAll(path+".1"))
+	entry.Time = time.Unix(4, 0).UTC()
+	l.Record(entry)
+	require.NoError(t, l.Close())
+
+	require.Equal(t, []int64{0, 1, 2, 3}, readTimes(t, path+".1"))
+	require.Equal(t, []int64{4}, readTimes(t, path))
+}
+
+// readTimes returns the times of the entries in the audit log file at 'path', in seconds.
+func readTimes(t *testing.T, path string) []int64 {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var times []int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		times = append(times, e.Time.Unix())
+	}
+	require.NoError(t, scanner.Err())
+	return times
+}
+
+func TestRecordPrefix(t *testing.T) {
+	l, err := Open(Stdout, 0)
+	require.NoError(t, err)
+	require.Equal(t, StdoutPrefix, l.prefix)
+
+	var buf bytes.Buffer
+	l.w = nopCloser{&buf}
+	entry := Entry{Time: time.Unix(0, 0).UTC(), Call: CallAllocate, Resource: "nvidia.com/gpu", Devices: []string{"GPU-0"}}
+	l.Record(entry)
+	l.Record(entry)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		require.True(t, strings.HasPrefix(line, StdoutPrefix), line)
+		var e Entry
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, StdoutPrefix)), &e))
+		require.Equal(t, entry, e)
+	}
+}
+
+func TestRecordNil(t *testing.T) {
+	var l *Log
+	l.Record(Entry{Call: CallAllocate})
+	require.NoError(t, l.Close())
+}
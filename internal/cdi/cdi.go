@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cdi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Constants related to the CDI specs generated by the plugin
+const (
+	SpecVersion      = "0.5.0"
+	Vendor           = "k8s.device-plugin.nvidia.com"
+	Class            = "gpu"
+	Kind             = Vendor + "/" + Class
+	DefaultSpecDir   = "/var/run/cdi"
+	AnnotationPrefix = "cdi.k8s.io/"
+
+	HookCreateContainer = "createContainer"
+)
+
+// Spec is the subset of a CDI specification generated by the plugin.
+type Spec struct {
+	Version        string         `json:"cdiVersion"`
+	Kind           string         `json:"kind"`
+	Devices        []Device       `json:"devices"`
+	ContainerEdits ContainerEdits `json:"containerEdits,omitempty"`
+}
+
+// Device is a single named device in a CDI specification.
+type Device struct {
+	Name           string         `json:"name"`
+	ContainerEdits ContainerEdits `json:"containerEdits"`
+}
+
+// ContainerEdits holds the edits a runtime applies to a container requesting a CDI device.
+type ContainerEdits struct {
+	Env         []string      `json:"env,omitempty"`
+	DeviceNodes []*DeviceNode `json:"deviceNodes,omitempty"`
+	Mounts      []*Mount      `json:"mounts,omitempty"`
+	Hooks       []*Hook       `json:"hooks,omitempty"`
+}
+
+// DeviceNode is a device node to be injected into a container.
+type DeviceNode struct {
+	Path     string `json:"path"`
+	HostPath string `json:"hostPath,omitempty"`
+}
+
+// Mount is a file or directory to be mounted into a container.
+type Mount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// Hook is an OCI hook to be run for a container.
+type Hook struct {
+	HookName string   `json:"hookName"`
+	Path     string   `json:"path"`
+	Args     []string `json:"args,omitempty"`
+}
+
+// NewSpec builds a Spec of kind 'Kind' with one entry per device in 'devices'.
+// Each entry maps a device name to the set of device node paths it requires.
+// The device nodes in 'common' and the files of 'driver' (if not nil) are added to every container requesting
+// any of the devices, so that containers get a working driver without relying on the NVIDIA runtime hook.
+func NewSpec(driverRoot string, devices map[string][]string, common []string, driver *Driver) *Spec {
+	spec := &Spec{
+		Version: SpecVersion,
+		Kind:    Kind,
+	}
+	if driver != nil {
+		spec.ContainerEdits = driver.ContainerEdits(driverRoot)
+	}
+	spec.ContainerEdits.DeviceNodes = newDeviceNodes(driverRoot, common)
+
+	var names []string
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		device := Device{
+			Name: name,
+			ContainerEdits: ContainerEdits{
+				DeviceNodes: newDeviceNodes(driverRoot, devices[name]),
+			},
+		}
+		spec.Devices = append(spec.Devices, device)
+	}
+
+	return spec
+}
+
+// Write atomically writes the Spec as a YAML file to the specified path.
+func (s *Spec) Write(path string) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error marshaling CDI spec: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating CDI spec directory: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing temporary CDI spec file: %v", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error moving CDI spec file into place: %v", err)
+	}
+
+	return nil
+}
+
+// SpecPath returns the path of the spec file generated for a given resource.
+func SpecPath(dir string, resource string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.yaml", Vendor, resource))
+}
+
+// QualifiedName returns the fully-qualified CDI name for a device of kind 'Kind'.
+func QualifiedName(device string) string {
+	return Kind + "=" + device
+}
+
+// Annotations returns the set of container annotations used to request 'devices' via CDI.
+// The key is built from the plugin name and a per-request claim ID as expected by CDI-enabled runtimes.
+func Annotations(plugin string, claimID string, devices []string) map[string]string {
+	var qualified []string
+	for _, d := range devices {
+		qualified = append(qualified, QualifiedName(d))
+	}
+	key := AnnotationPrefix + plugin + "_" + claimID
+	return map[string]string{
+		key: strings.Join(qualified, ","),
+	}
+}
+
+// newDeviceNodes builds the set of DeviceNodes for a list of paths under a given driver root.
+func newDeviceNodes(driverRoot string, paths []string) []*DeviceNode {
+	var nodes []*DeviceNode
+	for _, p := range paths {
+		node := &DeviceNode{
+			Path:     p,
+			HostPath: filepath.Join(driverRoot, p),
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNewSpec(t *testing.T) {
+	devices := map[string][]string{
+		"GPU-1": {"/dev/nvidia1"},
+		"GPU-0": {"/dev/nvidia0"},
+	}
+	common := []string{"/dev/nvidiactl"}
+
+	driver := &Driver{
+		Libraries:     []string{"/usr/lib64/libcuda.so.520.61.05"},
+		Binaries:      []string{"/usr/bin/nvidia-smi"},
+		NvidiaCTKPath: DefaultNvidiaCTKPath,
+	}
+
+	spec := NewSpec("/run/nvidia/driver", devices, common, driver)
+
+	require.Equal(t, Kind, spec.Kind)
+	require.Len(t, spec.Devices, 2)
+	require.Equal(t, "GPU-0", spec.Devices[0].Name)
+	require.Equal(t, "GPU-1", spec.Devices[1].Name)
+	require.Equal(t, "/dev/nvidia0", spec.Devices[0].ContainerEdits.DeviceNodes[0].Path)
+	require.Equal(t, "/run/nvidia/driver/dev/nvidia0", spec.Devices[0].ContainerEdits.DeviceNodes[0].HostPath)
+	require.Equal(t, "/run/nvidia/driver/dev/nvidiactl", spec.ContainerEdits.DeviceNodes[0].HostPath)
+	require.Empty(t, spec.ContainerEdits.Env)
+	require.Len(t, spec.ContainerEdits.Mounts, 2)
+	require.Equal(t, "/run/nvidia/driver/usr/lib64/libcuda.so.520.61.05", spec.ContainerEdits.Mounts[0].HostPath)
+	require.Equal(t, "/usr/bin/nvidia-smi", spec.ContainerEdits.Mounts[1].ContainerPath)
+	require.Len(t, spec.ContainerEdits.Hooks, 1)
+}
+
+func TestWriteSpec(t *testing.T) {
+	path := SpecPath(t.TempDir(), "gpu")
+	require.Equal(t, Vendor+"-gpu.yaml", filepath.Base(path))
+
+	spec := NewSpec("/", map[string][]string{"0": {"/dev/nvidia0"}}, nil, nil)
+	require.NoError(t, spec.Write(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var read Spec
+	require.NoError(t, yaml.Unmarshal(data, &read))
+	require.Equal(t, *spec, read)
+}
+
+func TestAnnotations(t *testing.T) {
+	annotations := Annotations("nvidia-device-plugin", "claim", []string{"GPU-0", "GPU-1"})
+
+	expected := map[string]string{
+		"cdi.k8s.io/nvidia-device-plugin_claim": Kind + "=GPU-0," + Kind + "=GPU-1",
+	}
+	require.Equal(t, expected, annotations)
+}
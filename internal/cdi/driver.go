@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cdi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultNvidiaCTKPath is the default path of the nvidia-ctk binary run by the hooks in generated specs.
+const DefaultNvidiaCTKPath = "/usr/bin/nvidia-ctk"
+
+// driverLibraries lists the names (without the version suffix) of the driver libraries injected into containers.
+// These match the 'compute' and 'utility' driver capabilities of the NVIDIA Container Toolkit.
+var driverLibraries = []string{
+	"libcuda.so",
+	"libcudadebugger.so",
+	"libnvidia-allocator.so",
+	"libnvidia-cfg.so",
+	"libnvidia-compiler.so",
+	"libnvidia-fatbinaryloader.so",
+	"libnvidia-ml.so",
+	"libnvidia-nvvm.so",
+	"libnvidia-opencl.so",
+	"libnvidia-ptxjitcompiler.so",
+}
+
+// driverBinaries lists the driver binaries injected into containers.
+var driverBinaries = []string{
+	"nvidia-smi",
+	"nvidia-debugdump",
+	"nvidia-persistenced",
+	"nvidia-cuda-mps-control",
+	"nvidia-cuda-mps-server",
+}
+
+// libraryDirs lists the directories searched for driver libraries, in order of preference.
+var libraryDirs = []string{
+	"/usr/lib64",
+	"/usr/lib/x86_64-linux-gnu",
+	"/usr/lib/aarch64-linux-gnu",
+	"/usr/lib",
+	"/lib64",
+	"/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu",
+}
+
+// binaryDirs lists the directories searched for driver binaries, in order of preference.
+var binaryDirs = []string{
+	"/usr/bin",
+	"/usr/sbin",
+	"/bin",
+	"/sbin",
+}
+
+// Driver holds the files of a driver installation that are injected into every container requesting a device.
+// All paths are absolute paths relative to the driver root.
+type Driver struct {
+	Libraries []string
+	Binaries  []string
+	// Links maps the symlinks to the driver libraries (e.g. libcuda.so.1) to their targets.
+	Links map[string]string
+	// NvidiaCTKPath is the path of the nvidia-ctk binary on the host, used to run the container hooks.
+	NvidiaCTKPath string
+}
+
+// DiscoverDriver finds the driver libraries and binaries of the driver installation visible at 'root'.
+// The first of libraryDirs containing any driver library is used, and the first of binaryDirs containing each binary.
+func DiscoverDriver(root string, nvidiaCTKPath string) (*Driver, error) {
+	driver := &Driver{
+		Links:         make(map[string]string),
+		NvidiaCTKPath: nvidiaCTKPath,
+	}
+
+	for _, dir := range libraryDirs {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading library directory '%v': %v", dir, err)
+		}
+
+		for _, e := range entries {
+			if !isDriverLibrary(e.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			if e.Type()&os.ModeSymlink != 0 {
+				target, err := os.Readlink(filepath.Join(root, path))
+				if err != nil {
+					return nil, fmt.Errorf("error reading link '%v': %v", path, err)
+				}
+				driver.Links[path] = target
+				continue
+			}
+			if e.Type().IsRegular() {
+				driver.Libraries = append(driver.Libraries, path)
+			}
+		}
+		if len(driver.Libraries) > 0 {
+			break
+		}
+		driver.Links = make(map[string]string)
+	}
+
+	for _, name := range driverBinaries {
+		for _, dir := range binaryDirs {
+			path := filepath.Join(dir, name)
+			info, err := os.Stat(filepath.Join(root, path))
+			if err == nil && info.Mode().IsRegular() {
+				driver.Binaries = append(driver.Binaries, path)
+				break
+			}
+		}
+	}
+
+	if len(driver.Libraries) == 0 {
+		return nil, fmt.Errorf("no driver libraries found under '%v'", root)
+	}
+
+	return driver, nil
+}
+
+// ContainerEdits returns the mounts and hooks that inject the driver installed at 'driverRoot' on the host into a container.
+// The libraries and binaries are bind-mounted read-only, the links to the libraries are recreated, and the linker cache
+// of the container is updated so that the libraries are found.
+func (d *Driver) ContainerEdits(driverRoot string) ContainerEdits {
+	var edits ContainerEdits
+
+	for _, p := range append(append([]string{}, d.Libraries...), d.Binaries...) {
+		mount := &Mount{
+			HostPath:      filepath.Join(driverRoot, p),
+			ContainerPath: p,
+			Options:       []string{"ro", "nosuid", "nodev", "bind"},
+		}
+		edits.Mounts = append(edits.Mounts, mount)
+	}
+
+	if len(d.Links) > 0 {
+		var links []string
+		for link := range d.Links {
+			links = append(links, link)
+		}
+		sort.Strings(links)
+
+		args := []string{"nvidia-ctk", "hook", "create-symlinks"}
+		for _, link := range links {
+			args = append(args, "--link", d.Links[link]+"::"+link)
+		}
+		edits.Hooks = append(edits.Hooks, d.newHook(args))
+	}
+
+	folders := make(map[string]bool)
+	for _, p := range d.Libraries {
+		folders[filepath.Dir(p)] = true
+	}
+	if len(folders) > 0 {
+		var dirs []string
+		for dir := range folders {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+
+		args := []string{"nvidia-ctk", "hook", "update-ldcache"}
+		for _, dir := range dirs {
+			args = append(args, "--folder", dir)
+		}
+		edits.Hooks = append(edits.Hooks, d.newHook(args))
+	}
+
+	return edits
+}
+
+// newHook returns a createContainer hook running nvidia-ctk with the given arguments.
+func (d *Driver) newHook(args []string) *Hook {
+	return &Hook{
+		HookName: HookCreateContainer,
+		Path:     d.NvidiaCTKPath,
+		Args:     args,
+	}
+}
+
+// isDriverLibrary returns whether 'name' is a (versioned) file name of one of driverLibraries.
+func isDriverLibrary(name string) bool {
+	for _, lib := range driverLibraries {
+		if name == lib || strings.HasPrefix(name, lib+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDriverRoot creates a driver installation with the given files and symlinks (mapped to their targets) under a temporary root.
+func newTestDriverRoot(t *testing.T, files []string, links map[string]string) string {
+	root := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(root, f)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, nil, 0755))
+	}
+	for link, target := range links {
+		path := filepath.Join(root, link)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.Symlink(target, path))
+	}
+	return root
+}
+
+func TestDiscoverDriver(t *testing.T) {
+	testCases := []struct {
+		description string
+		files       []string
+		links       map[string]string
+		expected    *Driver
+		expectedErr bool
+	}{
+		{
+			description: "libraries, links, and binaries",
+			files: []string{
+				"/usr/lib/x86_64-linux-gnu/libcuda.so.520.61.05",
+				"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.520.61.05",
+				"/usr/lib/x86_64-linux-gnu/libc.so.6",
+				"/usr/bin/nvidia-smi",
+				"/usr/bin/ls",
+			},
+			links: map[string]string{
+				"/usr/lib/x86_64-linux-gnu/libcuda.so.1": "libcuda.so.520.61.05",
+				"/usr/lib/x86_64-linux-gnu/libcuda.so":   "libcuda.so.1",
+			},
+			expected: &Driver{
+				Libraries: []string{
+					"/usr/lib/x86_64-linux-gnu/libcuda.so.520.61.05",
+					"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.520.61.05",
+				},
+				Binaries: []string{"/usr/bin/nvidia-smi"},
+				Links: map[string]string{
+					"/usr/lib/x86_64-linux-gnu/libcuda.so.1": "libcuda.so.520.61.05",
+					"/usr/lib/x86_64-linux-gnu/libcuda.so":   "libcuda.so.1",
+				},
+				NvidiaCTKPath: DefaultNvidiaCTKPath,
+			},
+		},
+		{
+			description: "first library directory with driver libraries is used",
+			files: []string{
+				"/usr/lib64/libnvidia-ml.so.470.82.01",
+				"/usr/lib/libnvidia-ml.so.390.12",
+			},
+			expected: &Driver{
+				Libraries:     []string{"/usr/lib64/libnvidia-ml.so.470.82.01"},
+				Links:         map[string]string{},
+				NvidiaCTKPath: DefaultNvidiaCTKPath,
+			},
+		},
+		{
+			description: "no driver libraries",
+			files:       []string{"/usr/lib64/libc.so.6", "/usr/bin/nvidia-smi"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			root := newTestDriverRoot(t, tc.files, tc.links)
+
+			driver, err := DiscoverDriver(root, DefaultNvidiaCTKPath)
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, driver)
+		})
+	}
+}
+
+func TestDriverContainerEdits(t *testing.T) {
+	driver := &Driver{
+		Libraries: []string{
+			"/usr/lib64/libcuda.so.520.61.05",
+			"/usr/lib64/libnvidia-ml.so.520.61.05",
+		},
+		Binaries: []string{"/usr/bin/nvidia-smi"},
+		Links: map[string]string{
+			"/usr/lib64/libcuda.so":   "libcuda.so.1",
+			"/usr/lib64/libcuda.so.1": "libcuda.so.520.61.05",
+		},
+		NvidiaCTKPath: "/usr/local/bin/nvidia-ctk",
+	}
+
+	edits := driver.ContainerEdits("/run/nvidia/driver")
+
+	options := []string{"ro", "nosuid", "nodev", "bind"}
+	expected := ContainerEdits{
+		Mounts: []*Mount{
+			{HostPath: "/run/nvidia/driver/usr/lib64/libcuda.so.520.61.05", ContainerPath: "/usr/lib64/libcuda.so.520.61.05", Options: options},
+			{HostPath: "/run/nvidia/driver/usr/lib64/libnvidia-ml.so.520.61.05", ContainerPath: "/usr/lib64/libnvidia-ml.so.520.61.05", Options: options},
+			{HostPath: "/run/nvidia/driver/usr/bin/nvidia-smi", ContainerPath: "/usr/bin/nvidia-smi", Options: options},
+		},
+		Hooks: []*Hook{
+			{
+				HookName: HookCreateContainer,
+				Path:     "/usr/local/bin/nvidia-ctk",
+				Args: []string{
+					"nvidia-ctk", "hook", "create-symlinks",
+					"--link", "libcuda.so.1::/usr/lib64/libcuda.so",
+					"--link", "libcuda.so.520.61.05::/usr/lib64/libcuda.so.1",
+				},
+			},
+			{
+				HookName: HookCreateContainer,
+				Path:     "/usr/local/bin/nvidia-ctk",
+				Args:     []string{"nvidia-ctk", "hook", "update-ldcache", "--folder", "/usr/lib64"},
+			},
+		},
+	}
+	require.Equal(t, expected, edits)
+}
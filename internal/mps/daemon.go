@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mps
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Constants related to running MPS control daemons
+const (
+	DefaultRoot = "/run/nvidia/mps"
+
+	controlBinary = "nvidia-cuda-mps-control"
+)
+
+// Timeouts used while supervising MPS control daemons (overridden in tests)
+var (
+	restartDelay = 5 * time.Second
+	stopTimeout  = 10 * time.Second
+)
+
+// Constants for the environment variables and paths used by MPS clients
+const (
+	PipeDirectoryEnvvar          = "CUDA_MPS_PIPE_DIRECTORY"
+	LogDirectoryEnvvar           = "CUDA_MPS_LOG_DIRECTORY"
+	ActiveThreadPercentageEnvvar = "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE"
+
+	ContainerPipeDirectory = "/tmp/nvidia-mps"
+	ContainerLogDirectory  = "/var/log/nvidia-mps"
+	ContainerShmDirectory  = "/dev/shm"
+)
+
+// Daemon supervises an MPS control daemon for a single device (full GPU or MIG device).
+type Daemon struct {
+	mu         sync.Mutex
+	uuid       string
+	root       string
+	driverRoot string
+
+	// isolateShm runs the daemon in its own mount namespace with ShmDir mounted over /dev/shm.
+	isolateShm bool
+
+	cmd     *exec.Cmd
+	stopped bool
+	exited  chan struct{}
+}
+
+// NewDaemon creates a new Daemon for the device with the given UUID.
+// All state for the daemon is kept in a per-device directory under 'root'.
+func NewDaemon(root string, driverRoot string, uuid string) *Daemon {
+	return &Daemon{
+		uuid:       uuid,
+		root:       root,
+		driverRoot: driverRoot,
+		isolateShm: true,
+	}
+}
+
+// PipeDir returns the host path of the directory holding the pipes of the daemon.
+func (d *Daemon) PipeDir() string {
+	return filepath.Join(d.root, d.uuid, "pipe")
+}
+
+// LogDir returns the host path of the directory holding the logs of the daemon.
+func (d *Daemon) LogDir() string {
+	return filepath.Join(d.root, d.uuid, "log")
+}
+
+// ShmDir returns the host path of the shared memory directory used by the daemon and its clients.
+// Only the clients of this daemon share the directory, and it is mounted as their /dev/shm.
+func (d *Daemon) ShmDir() string {
+	return filepath.Join(d.root, d.uuid, "shm")
+}
+
+// Start launches the MPS control daemon and restarts it whenever it exits until Stop is called.
+func (d *Daemon) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, dir := range []string{d.PipeDir(), d.LogDir(), d.ShmDir()} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("error creating directory %v: %v", dir, err)
+		}
+	}
+
+	d.stopped = false
+	err := d.start()
+	if err != nil {
+		return err
+	}
+	log.Printf("Started MPS control daemon for %s", d.uuid)
+
+	return nil
+}
+
+// Stop asks the MPS control daemon to quit, killing it if it does not exit in time.
+func (d *Daemon) Stop() error {
+	d.mu.Lock()
+	if d.stopped || d.cmd == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	d.stopped = true
+	exited := d.exited
+	process := d.cmd.Process
+	d.mu.Unlock()
+
+	quit := d.command()
+	quit.Stdin = strings.NewReader("quit\n")
+	if output, err := quit.CombinedOutput(); err != nil {
+		log.Printf("Failed to send quit to MPS control daemon for %s: %v: %s", d.uuid, err, output)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		log.Printf("MPS control daemon for %s did not quit after %v, killing it", d.uuid, stopTimeout)
+		if err := process.Kill(); err != nil {
+			return fmt.Errorf("error killing MPS control daemon for %s: %v", d.uuid, err)
+		}
+		<-exited
+	}
+	log.Printf("Stopped MPS control daemon for %s", d.uuid)
+
+	return nil
+}
+
+// start launches the daemon in the foreground and monitors it in the background.
+// It must be called with the lock held.
+func (d *Daemon) start() error {
+	cmd := d.command("-f")
+	if d.isolateShm {
+		cmd = d.isolate(cmd)
+	}
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error starting MPS control daemon for %s: %v", d.uuid, err)
+	}
+	d.cmd = cmd
+	d.exited = make(chan struct{})
+	go d.monitor(cmd, d.exited)
+	return nil
+}
+
+// monitor waits for the daemon process to exit and restarts it unless the daemon has been stopped.
+func (d *Daemon) monitor(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	close(exited)
+
+	d.mu.Lock()
+	stopped := d.stopped
+	d.mu.Unlock()
+	if stopped {
+		return
+	}
+
+	log.Printf("MPS control daemon for %s exited unexpectedly (%v), restarting in %v", d.uuid, err, restartDelay)
+	time.Sleep(restartDelay)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	if err := d.start(); err != nil {
+		log.Printf("Failed to restart MPS control daemon: %v", err)
+	}
+}
+
+// command builds an invocation of the MPS control binary targeting this daemon.
+func (d *Daemon) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(d.binary(), args...)
+	cmd.Env = append(os.Environ(),
+		"CUDA_VISIBLE_DEVICES="+d.uuid,
+		PipeDirectoryEnvvar+"="+d.PipeDir(),
+		LogDirectoryEnvvar+"="+d.LogDir(),
+	)
+	return cmd
+}
+
+// isolate wraps 'cmd' so that it runs in a private mount namespace, with the
+// shared memory directory of the daemon bind-mounted over /dev/shm. This keeps
+// the shared memory of each daemon (and of its clients) apart from that of the
+// other daemons and of the plugin itself.
+func (d *Daemon) isolate(cmd *exec.Cmd) *exec.Cmd {
+	script := `mount --bind "$1" /dev/shm && shift && exec "$@"`
+	args := append([]string{"-c", script, "sh", d.ShmDir()}, cmd.Args...)
+	wrapped := exec.Command("/bin/sh", args...)
+	wrapped.Env = cmd.Env
+	wrapped.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+	return wrapped
+}
+
+// binary returns the path to the MPS control binary, preferring the one under the driver root.
+func (d *Daemon) binary() string {
+	path := filepath.Join(d.driverRoot, "usr", "bin", controlBinary)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return controlBinary
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mps
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeControl is a stand-in for nvidia-cuda-mps-control. In the foreground
+// ('-f') it records its PID in the log directory and sleeps; otherwise it
+// reads a command from stdin and, if 'handleQuit' is set, kills the last
+// recorded daemon on 'quit'.
+const fakeControl = `#!/bin/sh
+if [ "$1" = "-f" ]; then
+	echo $$ >> "$CUDA_MPS_LOG_DIRECTORY/pids"
+	exec sleep 60
+fi
+read cmd
+if [ "$cmd" = "quit" ] && [ -n "%s" ]; then
+	kill $(tail -n 1 "$CUDA_MPS_LOG_DIRECTORY/pids")
+fi
+`
+
+func newTestDaemon(t *testing.T, handleQuit bool) *Daemon {
+	driverRoot := t.TempDir()
+	bin := filepath.Join(driverRoot, "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0755))
+
+	quit := ""
+	if handleQuit {
+		quit = "yes"
+	}
+	script := fmt.Sprintf(fakeControl, quit)
+	require.NoError(t, os.WriteFile(filepath.Join(bin, controlBinary), []byte(script), 0755))
+
+	d := NewDaemon(t.TempDir(), driverRoot, "GPU-0")
+	// Isolating /dev/shm requires privileges the tests do not have.
+	d.isolateShm = false
+	return d
+}
+
+// pids returns the PIDs of all daemon processes started so far.
+func pids(t *testing.T, d *Daemon) []string {
+	data, err := os.ReadFile(filepath.Join(d.LogDir(), "pids"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return strings.Fields(string(data))
+}
+
+func setTimeouts(t *testing.T, restart, stop time.Duration) {
+	oldRestart, oldStop := restartDelay, stopTimeout
+	restartDelay, stopTimeout = restart, stop
+	t.Cleanup(func() {
+		restartDelay, stopTimeout = oldRestart, oldStop
+	})
+}
+
+func TestDaemonStartCreatesDirectories(t *testing.T) {
+	d := newTestDaemon(t, true)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+	require.Eventually(t, func() bool { return len(pids(t, d)) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	for _, dir := range []string{d.PipeDir(), d.LogDir(), d.ShmDir()} {
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		require.True(t, info.IsDir())
+	}
+}
+
+func TestDaemonStop(t *testing.T) {
+	setTimeouts(t, 10*time.Millisecond, 5*time.Second)
+	d := newTestDaemon(t, true)
+	require.NoError(t, d.Start())
+	require.Eventually(t, func() bool { return len(pids(t, d)) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, d.Stop())
+	require.True(t, time.Since(start) < stopTimeout)
+
+	// A stopped daemon is not restarted, and stopping it again is a no-op.
+	time.Sleep(10 * restartDelay)
+	require.Len(t, pids(t, d), 1)
+	require.NoError(t, d.Stop())
+}
+
+func TestDaemonStopKillsUnresponsiveDaemon(t *testing.T) {
+	setTimeouts(t, time.Second, 100*time.Millisecond)
+	d := newTestDaemon(t, false)
+	require.NoError(t, d.Start())
+
+	require.NoError(t, d.Stop())
+	require.Len(t, pids(t, d), 1)
+}
+
+func TestDaemonRestartsAfterExit(t *testing.T) {
+	setTimeouts(t, 10*time.Millisecond, 5*time.Second)
+	d := newTestDaemon(t, true)
+	require.NoError(t, d.Start())
+	require.Eventually(t, func() bool { return len(pids(t, d)) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	d.mu.Lock()
+	process := d.cmd.Process
+	d.mu.Unlock()
+	require.NoError(t, process.Kill())
+
+	require.Eventually(t, func() bool { return len(pids(t, d)) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, d.Stop())
+}
+
+func TestDaemonIsolatesShm(t *testing.T) {
+	d := NewDaemon("/run/nvidia/mps", "/", "GPU-0")
+	cmd := d.isolate(d.command("-f"))
+
+	require.Equal(t, "/bin/sh", cmd.Path)
+	require.Equal(t, []string{"/run/nvidia/mps/GPU-0/shm", d.binary(), "-f"}, cmd.Args[4:])
+	require.NotNil(t, cmd.SysProcAttr)
+	require.Contains(t, cmd.Env, "CUDA_VISIBLE_DEVICES=GPU-0")
+}
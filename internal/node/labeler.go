@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Labeler updates the labels of a single Kubernetes node.
+type Labeler struct {
+	clientset kubernetes.Interface
+	name      string
+}
+
+// NewLabeler creates a Labeler for the node with the given name.
+// If 'kubeconfig' is empty, the in-cluster config is used.
+func NewLabeler(kubeconfig string, name string) (*Labeler, error) {
+	if name == "" {
+		return nil, fmt.Errorf("no node name specified")
+	}
+
+	clientset, err := newClientset(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLabelerForClientset(clientset, name), nil
+}
+
+// NewLabelerForClientset creates a Labeler for the node with the given name using an existing clientset.
+func NewLabelerForClientset(clientset kubernetes.Interface, name string) *Labeler {
+	return &Labeler{
+		clientset: clientset,
+		name:      name,
+	}
+}
+
+// Annotation returns the value of the given annotation on the node ("" if it is not set).
+func (l *Labeler) Annotation(key string) (string, error) {
+	node, err := l.clientset.CoreV1().Nodes().Get(context.TODO(), l.name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting node '%v': %v", l.name, err)
+	}
+	return node.Annotations[key], nil
+}
+
+// Update sets the given labels on the node and removes any labels listed in 'remove'.
+func (l *Labeler) Update(labels map[string]string, remove ...string) error {
+	return l.UpdateWithAnnotations(labels, nil, remove...)
+}
+
+// UpdateWithAnnotations sets the given labels and annotations on the node and removes any labels listed in 'remove'.
+// All changes are applied in a single patch.
+func (l *Labeler) UpdateWithAnnotations(labels map[string]string, annotations map[string]string, remove ...string) error {
+	patchLabels := make(map[string]interface{})
+	for k, v := range labels {
+		patchLabels[k] = v
+	}
+	for _, k := range remove {
+		patchLabels[k] = nil
+	}
+	if len(patchLabels) == 0 && len(annotations) == 0 {
+		return nil
+	}
+
+	metadata := map[string]interface{}{
+		"labels": patchLabels,
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	patch := map[string]interface{}{
+		"metadata": metadata,
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("error marshaling label patch: %v", err)
+	}
+
+	_, err = l.clientset.CoreV1().Nodes().Patch(context.TODO(), l.name, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("error patching labels of node '%v': %v", l.name, err)
+	}
+
+	return nil
+}
+
+// newClientset builds a kubernetes clientset from 'kubeconfig' (or the in-cluster config if it is empty).
+func newClientset(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("error building kubernetes clientcmd config: %v", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error building kubernetes clientset from config: %v", err)
+	}
+
+	return clientset, nil
+}
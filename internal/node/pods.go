@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Pods evicts and annotates the pods running on a node.
+type Pods struct {
+	clientset kubernetes.Interface
+}
+
+// NewPods creates a Pods client.
+// If 'kubeconfig' is empty, the in-cluster config is used.
+func NewPods(kubeconfig string) (*Pods, error) {
+	clientset, err := newClientset(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewPodsForClientset(clientset), nil
+}
+
+// NewPodsForClientset creates a Pods client using an existing clientset.
+func NewPodsForClientset(clientset kubernetes.Interface) *Pods {
+	return &Pods{clientset: clientset}
+}
+
+// Evict evicts the given pod through the eviction API, so that the PodDisruptionBudgets covering it are respected.
+// It returns false if the eviction was refused (e.g. because it would violate a PodDisruptionBudget).
+// Pods that no longer exist are ignored.
+func (p *Pods) Evict(namespace string, name string) (bool, error) {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+	err := p.clientset.PolicyV1beta1().Evictions(namespace).Evict(context.TODO(), eviction)
+	if errors.IsTooManyRequests(err) {
+		return false, nil
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return false, fmt.Errorf("error evicting pod '%v/%v': %v", namespace, name, err)
+	}
+	return true, nil
+}
+
+// Annotate sets the given annotations on a pod. Pods that no longer exist are ignored.
+func (p *Pods) Annotate(namespace string, name string, annotations map[string]string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("error marshaling annotation patch: %v", err)
+	}
+
+	_, err = p.clientset.CoreV1().Pods(namespace).Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error patching annotations of pod '%v/%v': %v", namespace, name, err)
+	}
+	return nil
+}
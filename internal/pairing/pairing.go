@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pairing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultSysfsRoot is the root of the sysfs tree used to discover GPU and NIC affinity.
+const DefaultSysfsRoot = "/sys"
+
+// GPU is a GPU (or MIG device) to be paired with a NIC.
+type GPU struct {
+	ID    string
+	BusID string
+}
+
+// Pair is a GPU together with the RDMA NIC closest to it on the PCIe tree.
+// SameSwitch is set if traffic between the two does not have to pass through the host bridge of the CPU.
+type Pair struct {
+	GPU        string `json:"gpu"`
+	GPUBusID   string `json:"gpuBusID"`
+	NIC        string `json:"nic"`
+	NICBusID   string `json:"nicBusID"`
+	SameSwitch bool   `json:"sameSwitch"`
+}
+
+// Hints is the set of GPU / NIC pairs shared with other device plugins through a hint file.
+type Hints struct {
+	Pairs []Pair `json:"pairs"`
+}
+
+// nic is an RDMA NIC and its position on the PCIe tree.
+type nic struct {
+	name  string
+	busID string
+	path  []string
+}
+
+// Discover pairs each GPU with the RDMA NIC closest to it.
+// The position of all devices on the PCIe tree is read from the sysfs tree rooted at 'sysfs'.
+// When several NICs are equally close to a GPU, NICs not yet paired with another GPU are preferred,
+// so that GPUs sharing a PCIe switch with several NICs are spread across them.
+func Discover(sysfs string, gpus []GPU) (*Hints, error) {
+	nics, err := discoverNICs(sysfs)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering RDMA NICs: %v", err)
+	}
+
+	sorted := append([]GPU{}, gpus...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].BusID != sorted[j].BusID {
+			return sorted[i].BusID < sorted[j].BusID
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	hints := &Hints{Pairs: []Pair{}}
+	if len(nics) == 0 {
+		return hints, nil
+	}
+
+	paired := make(map[string]int)
+	for _, gpu := range sorted {
+		path, err := pciPath(sysfs, filepath.Join("bus", "pci", "devices", gpu.BusID))
+		if err != nil {
+			return nil, fmt.Errorf("error getting PCIe path of GPU %v: %v", gpu.ID, err)
+		}
+
+		var best *nic
+		var bestCommon int
+		for i := range nics {
+			n := &nics[i]
+			common := commonPrefix(path, n.path)
+			if best == nil || common > bestCommon || (common == bestCommon && paired[n.name] < paired[best.name]) {
+				best = n
+				bestCommon = common
+			}
+		}
+		paired[best.name]++
+
+		pair := Pair{
+			GPU:      gpu.ID,
+			GPUBusID: gpu.BusID,
+			NIC:      best.name,
+			NICBusID: best.busID,
+			// The first element of a path is the root complex, so devices sharing more than that share a bridge below it.
+			SameSwitch: bestCommon > 1,
+		}
+		hints.Pairs = append(hints.Pairs, pair)
+	}
+
+	return hints, nil
+}
+
+// Write atomically writes the Hints as a JSON file to the specified path.
+func (h *Hints) Write(path string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling hints: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating hint file directory: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing temporary hint file: %v", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error moving hint file into place: %v", err)
+	}
+
+	return nil
+}
+
+// discoverNICs returns all RDMA NICs found under 'sysfs', sorted by name.
+func discoverNICs(sysfs string) ([]nic, error) {
+	dir := filepath.Join(sysfs, "class", "infiniband")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nics []nic
+	for _, e := range entries {
+		path, err := pciPath(sysfs, filepath.Join("class", "infiniband", e.Name(), "device"))
+		if err != nil {
+			return nil, fmt.Errorf("error getting PCIe path of NIC %v: %v", e.Name(), err)
+		}
+		n := nic{
+			name:  e.Name(),
+			busID: path[len(path)-1],
+			path:  path,
+		}
+		nics = append(nics, n)
+	}
+
+	sort.Slice(nics, func(i, j int) bool {
+		return nics[i].name < nics[j].name
+	})
+
+	return nics, nil
+}
+
+// pciPath resolves the sysfs entry of a PCI device to the chain of devices leading to it from its root complex.
+// For example, devices/pci0000:00/0000:00:01.0/0000:01:00.0 resolves to [pci0000:00 0000:00:01.0 0000:01:00.0].
+func pciPath(sysfs string, entry string) ([]string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(sysfs, entry))
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.EvalSymlinks(filepath.Join(sysfs, "devices"))
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%v is not a device under %v", resolved, root)
+	}
+
+	return strings.Split(rel, string(filepath.Separator)), nil
+}
+
+// commonPrefix returns the number of leading elements shared by two paths.
+func commonPrefix(a, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
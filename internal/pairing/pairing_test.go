@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pairing
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSysfs builds a sysfs tree with two PCIe switches below one root port each.
+// The first switch holds GPU 0, GPU 1, mlx5_0, and mlx5_2, the second one GPU 2 and mlx5_1.
+func newTestSysfs(t *testing.T) string {
+	sysfs := t.TempDir()
+
+	devices := map[string]string{
+		"0000:07:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:00.0/0000:07:00.0",
+		"0000:0f:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:01.0/0000:0f:00.0",
+		"0000:b7:00.0": "pci0000:80/0000:80:01.0/0000:81:00.0/0000:82:00.0/0000:b7:00.0",
+		"0000:0c:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:02.0/0000:0c:00.0",
+		"0000:bd:00.0": "pci0000:80/0000:80:01.0/0000:81:00.0/0000:82:01.0/0000:bd:00.0",
+		"0000:0d:00.0": "pci0000:00/0000:00:01.0/0000:01:00.0/0000:02:03.0/0000:0d:00.0",
+	}
+	for busID, path := range devices {
+		dir := filepath.Join(sysfs, "devices", path)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		link := filepath.Join(sysfs, "bus", "pci", "devices", busID)
+		require.NoError(t, os.MkdirAll(filepath.Dir(link), 0755))
+		require.NoError(t, os.Symlink(dir, link))
+	}
+
+	nics := map[string]string{
+		"mlx5_0": "0000:0c:00.0",
+		"mlx5_1": "0000:bd:00.0",
+		"mlx5_2": "0000:0d:00.0",
+	}
+	for name, busID := range nics {
+		dir := filepath.Join(sysfs, "class", "infiniband", name)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.Symlink(filepath.Join(sysfs, "bus", "pci", "devices", busID), filepath.Join(dir, "device")))
+	}
+
+	return sysfs
+}
+
+func TestDiscover(t *testing.T) {
+	sysfs := newTestSysfs(t)
+
+	gpus := []GPU{
+		{ID: "GPU-2", BusID: "0000:b7:00.0"},
+		{ID: "GPU-0", BusID: "0000:07:00.0"},
+		{ID: "GPU-1", BusID: "0000:0f:00.0"},
+	}
+
+	hints, err := Discover(sysfs, gpus)
+	require.NoError(t, err)
+
+	expected := []Pair{
+		{GPU: "GPU-0", GPUBusID: "0000:07:00.0", NIC: "mlx5_0", NICBusID: "0000:0c:00.0", SameSwitch: true},
+		{GPU: "GPU-1", GPUBusID: "0000:0f:00.0", NIC: "mlx5_2", NICBusID: "0000:0d:00.0", SameSwitch: true},
+		{GPU: "GPU-2", GPUBusID: "0000:b7:00.0", NIC: "mlx5_1", NICBusID: "0000:bd:00.0", SameSwitch: true},
+	}
+	require.Equal(t, expected, hints.Pairs)
+}
+
+func TestDiscoverWithoutNICs(t *testing.T) {
+	hints, err := Discover(t.TempDir(), []GPU{{ID: "GPU-0", BusID: "0000:07:00.0"}})
+	require.NoError(t, err)
+	require.Empty(t, hints.Pairs)
+}
+
+func TestWriteHints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hints", "pairs.json")
+
+	hints := &Hints{
+		Pairs: []Pair{{GPU: "GPU-0", GPUBusID: "0000:07:00.0", NIC: "mlx5_0", NICBusID: "0000:0c:00.0", SameSwitch: true}},
+	}
+	require.NoError(t, hints.Write(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var read Hints
+	require.NoError(t, json.Unmarshal(data, &read))
+	require.Equal(t, *hints, read)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package podresources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// Constants related to the kubelet pod-resources API
+const (
+	DefaultSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	timeout = 10 * time.Second
+)
+
+// Allocation is the set of devices of a single resource allocated to a container.
+type Allocation struct {
+	Namespace string
+	Pod       string
+	Container string
+	Resource  string
+	DeviceIDs []string
+}
+
+// Lister lists the device allocations of all containers on the node.
+type Lister interface {
+	List() ([]Allocation, error)
+}
+
+// socketLister is a Lister querying the kubelet pod-resources API on a socket.
+type socketLister string
+
+// NewLister returns a Lister querying the kubelet listening on 'socket'.
+func NewLister(socket string) Lister {
+	return socketLister(socket)
+}
+
+// List returns the device allocations of all containers known to the kubelet.
+func (s socketLister) List() ([]Allocation, error) {
+	return List(string(s))
+}
+
+// List returns the device allocations of all containers known to the kubelet listening on 'socket'.
+func List(socket string) ([]Allocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %v: %v", socket, err)
+	}
+	defer conn.Close()
+
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pod resources: %v", err)
+	}
+
+	var allocations []Allocation
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				allocation := Allocation{
+					Namespace: pod.GetNamespace(),
+					Pod:       pod.GetName(),
+					Container: container.GetName(),
+					Resource:  devices.GetResourceName(),
+					DeviceIDs: devices.GetDeviceIds(),
+				}
+				allocations = append(allocations, allocation)
+			}
+		}
+	}
+
+	return allocations, nil
+}
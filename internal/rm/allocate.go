@@ -18,38 +18,99 @@ package rm
 
 import (
 	"fmt"
+	"log"
+	"sort"
 
 	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
 )
 
 var alignedAllocationPolicy = gpuallocator.NewBestEffortPolicy()
 
+// Constants representing the algorithms used to calculate a preferred allocation
+const (
+	AllocationStrategyAligned  = "aligned"
+	AllocationStrategyPacked   = "packed"
+	AllocationStrategyStandard = "standard"
+)
+
+// AllocationDecision explains how a preferred allocation was calculated.
+// Scores holds the number of free replicas of each candidate GPU for the packed strategy (the lowest one that fits wins).
+// Links holds the links between each pair of allocated devices for the aligned strategy.
+type AllocationDecision struct {
+	Strategy string         `json:"strategy"`
+	Reason   string         `json:"reason"`
+	Scores   map[string]int `json:"scores,omitempty"`
+	Links    []DeviceLink   `json:"links,omitempty"`
+}
+
+// DeviceLink describes the links between two devices.
+type DeviceLink struct {
+	Devices [2]string `json:"devices"`
+	Links   []string  `json:"links"`
+}
+
 // getPreferredAllocation runs an allocation algorithm over the inputs.
 // The algorithm chosen is based both on the incoming set of available devices and various config settings.
-func (r *resourceManager) getPreferredAllocation(available, required []string, size int) ([]string, error) {
-	// If all of the available devices are full GPUs without replicas, then
-	// calculate an aligned allocation across those devices.
-	if !r.Devices().ContainsMigDevices() && !AnnotatedIDs(available).AnyHasAnnotations() {
-		return r.alignedAlloc(available, required, size)
+func (r *resourceManager) getPreferredAllocation(available, required []string, size int) ([]string, *AllocationDecision, error) {
+	// If the devices are fractions of GPUs, then all fractions must come from
+	// a single GPU, so pack them onto the GPU that fits them most tightly.
+	if r.isFractional() {
+		devices, scores, err := r.packedAlloc(available, required, size)
+		decision := &AllocationDecision{
+			Strategy: AllocationStrategyPacked,
+			Reason:   "devices are fractions of GPUs",
+			Scores:   scores,
+		}
+		return devices, decision, err
+	}
+
+	// If all of the available devices are full GPUs without replicas and their
+	// topology can be queried, then calculate an aligned allocation across those devices.
+	var reason string
+	switch {
+	case !r.caps.topology:
+		reason = "GPU topology cannot be queried"
+	case r.Devices().ContainsMigDevices():
+		reason = "devices include MIG devices"
+	case AnnotatedIDs(available).AnyHasAnnotations():
+		reason = "devices are shared replicas"
+	default:
+		devices, links, err := r.alignedAlloc(available, required, size)
+		if err == nil {
+			decision := &AllocationDecision{
+				Strategy: AllocationStrategyAligned,
+				Reason:   "devices are full GPUs with known topology",
+				Links:    links,
+			}
+			return devices, decision, nil
+		}
+		log.Printf("Unable to calculate an aligned allocation, falling back to a standard allocation: %v", err)
+		reason = fmt.Sprintf("aligned allocation failed: %v", err)
 	}
 
 	// Otherwise, run a standard allocation algorithm.
-	return r.alloc(available, required, size)
+	devices, err := r.alloc(available, required, size)
+	decision := &AllocationDecision{
+		Strategy: AllocationStrategyStandard,
+		Reason:   reason,
+	}
+	return devices, decision, err
 }
 
 // alignedAlloc shells out to the alignedAllocationPolicy that is set in
 // order to calculate the preferred allocation.
-func (r *resourceManager) alignedAlloc(available, required []string, size int) ([]string, error) {
+// It also returns the links between each pair of allocated devices.
+func (r *resourceManager) alignedAlloc(available, required []string, size int) ([]string, []DeviceLink, error) {
 	var devices []string
 
-	availableDevices, err := gpuallocator.NewDevicesFrom(available)
+	availableDevices, err := r.alignedDevices(available)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve list of available devices: %v", err)
+		return nil, nil, fmt.Errorf("unable to retrieve list of available devices: %v", err)
 	}
 
-	requiredDevices, err := gpuallocator.NewDevicesFrom(required)
+	requiredDevices, err := r.alignedDevices(required)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve list of required devices: %v", err)
+		return nil, nil, fmt.Errorf("unable to retrieve list of required devices: %v", err)
 	}
 
 	allocatedDevices := alignedAllocationPolicy.Allocate(availableDevices, requiredDevices, size)
@@ -58,7 +119,30 @@ func (r *resourceManager) alignedAlloc(available, required []string, size int) (
 		devices = append(devices, device.UUID)
 	}
 
-	return devices, nil
+	return devices, alignedLinks(allocatedDevices), nil
+}
+
+// alignedLinks returns the links between each pair of the given devices.
+func alignedLinks(devices []*gpuallocator.Device) []DeviceLink {
+	var links []DeviceLink
+	for i, d0 := range devices {
+		for _, d1 := range devices[i+1:] {
+			link := DeviceLink{Devices: [2]string{d0.UUID, d1.UUID}}
+			for _, l := range d0.Links[d1.Index] {
+				link.Links = append(link.Links, l.Type.String())
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// alignedDevices returns the devices with the given UUIDs and the links between them for use by the alignedAllocationPolicy.
+func (r *resourceManager) alignedDevices(uuids []string) ([]*gpuallocator.Device, error) {
+	if r.topology != nil {
+		return r.topology(uuids)
+	}
+	return gpuallocator.NewDevicesFrom(uuids)
 }
 
 // alloc runs a standard allocation algorithm to decide which devices should be preferred.
@@ -66,9 +150,72 @@ func (r *resourceManager) alignedAlloc(available, required []string, size int) (
 // in the future to implement a more sophisticated allocation algorithm.
 func (r *resourceManager) alloc(available, required []string, size int) ([]string, error) {
 	remainder := r.devices.Subset(available).Difference(r.devices.Subset(required)).GetIDs()
-	devices := append(required, remainder...)
+	// Copy 'required' so that appending to it never writes into the caller's slice.
+	devices := append(append([]string{}, required...), remainder...)
 	if len(devices) < size {
 		return nil, fmt.Errorf("not enough available devices to satisfy allocation")
 	}
 	return devices[:size], nil
 }
+
+// packedAlloc picks all devices from the replicas of a single GPU, preferring the GPU with
+// the fewest available replicas that can still satisfy the allocation (i.e. best fit).
+// This keeps the remaining GPUs as empty as possible for larger requests.
+// It also returns the number of available replicas of each candidate GPU.
+func (r *resourceManager) packedAlloc(available, required []string, size int) ([]string, map[string]int, error) {
+	replicas := make(map[string][]string)
+	for _, id := range r.devices.Subset(available).Difference(r.devices.Subset(required)).GetIDs() {
+		parent := AnnotatedID(id).GetID()
+		replicas[parent] = append(replicas[parent], id)
+	}
+
+	var parents []string
+	for parent := range replicas {
+		parents = append(parents, parent)
+	}
+
+	if len(required) > 0 {
+		parent := AnnotatedID(required[0]).GetID()
+		for _, id := range required {
+			if AnnotatedID(id).GetID() != parent {
+				return nil, nil, fmt.Errorf("required devices span more than one GPU")
+			}
+		}
+		parents = []string{parent}
+	}
+
+	scores := make(map[string]int)
+	var best string
+	for _, parent := range parents {
+		n := len(replicas[parent]) + len(required)
+		scores[parent] = n
+		if n < size {
+			continue
+		}
+		if best == "" || n < len(replicas[best])+len(required) || (n == len(replicas[best])+len(required) && parent < best) {
+			best = parent
+		}
+	}
+	if best == "" {
+		return nil, scores, fmt.Errorf("not enough available devices on a single GPU to satisfy allocation")
+	}
+
+	remainder := replicas[best]
+	sort.Slice(remainder, func(i, j int) bool {
+		_, ri := AnnotatedID(remainder[i]).Split()
+		_, rj := AnnotatedID(remainder[j]).Split()
+		return ri < rj
+	})
+	devices := append(append([]string{}, required...), remainder...)
+	return devices[:size], scores, nil
+}
+
+// isFractional checks if the devices of the resource manager are advertised in fractions of a GPU.
+func (r *resourceManager) isFractional() bool {
+	for _, fr := range r.config.Sharing.FractionalResources() {
+		if fr.Rename == r.resource {
+			return true
+		}
+	}
+	return false
+}
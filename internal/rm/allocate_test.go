@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReplicas(replicas map[string]int) Devices {
+	devices := make(Devices)
+	for parent, n := range replicas {
+		for i := 0; i < n; i++ {
+			d := &Device{}
+			d.ID = string(NewAnnotatedID(parent, i))
+			devices[d.ID] = d
+		}
+	}
+	return devices
+}
+
+func TestPackedAlloc(t *testing.T) {
+	testCases := []struct {
+		available map[string]int
+		required  []string
+		size      int
+		expected  []string
+		err       bool
+	}{
+		{
+			available: map[string]int{"GPU-0": 4, "GPU-1": 2},
+			size:      2,
+			expected:  []string{"GPU-1::0", "GPU-1::1"},
+		},
+		{
+			available: map[string]int{"GPU-0": 4, "GPU-1": 2},
+			size:      3,
+			expected:  []string{"GPU-0::0", "GPU-0::1", "GPU-0::2"},
+		},
+		{
+			available: map[string]int{"GPU-0": 2, "GPU-1": 2},
+			size:      1,
+			expected:  []string{"GPU-0::0"},
+		},
+		{
+			available: map[string]int{"GPU-0": 4, "GPU-1": 2},
+			required:  []string{"GPU-0::3"},
+			size:      2,
+			expected:  []string{"GPU-0::3", "GPU-0::0"},
+		},
+		{
+			available: map[string]int{"GPU-0": 4, "GPU-1": 2},
+			required:  []string{"GPU-0::3", "GPU-1::1"},
+			size:      2,
+			err:       true,
+		},
+		{
+			available: map[string]int{"GPU-0": 2, "GPU-1": 2},
+			size:      3,
+			err:       true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			r := &resourceManager{devices: newTestReplicas(tc.available)}
+			allocated, _, err := r.packedAlloc(r.devices.GetIDs(), tc.required, tc.size)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, allocated)
+		})
+	}
+}
+
+func TestAllocDoesNotModifyAvailable(t *testing.T) {
+	r := &resourceManager{devices: newTestReplicas(map[string]int{"GPU-0": 8})}
+
+	allocs := map[string]func(available, required []string, size int) ([]string, error){
+		"standard": r.alloc,
+		"packed": func(available, required []string, size int) ([]string, error) {
+			devices, _, err := r.packedAlloc(available, required, size)
+			return devices, err
+		},
+	}
+
+	for name, alloc := range allocs {
+		t.Run(name, func(t *testing.T) {
+			var available []string
+			for i := 7; i >= 0; i-- {
+				available = append(available, string(NewAnnotatedID("GPU-0", i)))
+			}
+			original := append([]string{}, available...)
+
+			// Pass a prefix of 'available' as 'required', so that both share a backing array.
+			devices, err := alloc(available, available[:1], 3)
+			require.NoError(t, err)
+			require.Len(t, devices, 3)
+			require.Equal(t, "GPU-0::7", devices[0])
+			require.Equal(t, original, available)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// capabilities records which optional driver features are available on the node.
+// When running inside a VM (e.g. with an NVIDIA vGPU) several NVML queries are
+// not supported, so the resource manager falls back to not using them.
+type capabilities struct {
+	// vgpu is set if any GPU on the node is a vGPU
+	vgpu bool
+	// topology is set if the GPU topology can be queried for aligned allocation
+	topology bool
+	// mig is set if the MIG mode of the GPUs can be queried
+	mig bool
+}
+
+// detectCapabilities probes the driver for the set of optional features it supports.
+func detectCapabilities() (*capabilities, error) {
+	caps := &capabilities{
+		topology: true,
+	}
+
+	var uuids []string
+	err := walkGPUDevices(func(i int, gpu nvml.Device) error {
+		uuid, ret := gpu.GetUUID()
+		if ret != nvml.SUCCESS {
+			return fmt.Errorf("error getting UUID for GPU with index '%v': %v", i, nvml.ErrorString(ret))
+		}
+		uuids = append(uuids, uuid)
+
+		vgpu, err := nvmlDevice(gpu).isVGPU()
+		if err != nil {
+			return fmt.Errorf("error checking virtualization mode of GPU with index '%v': %v", i, err)
+		}
+		caps.vgpu = caps.vgpu || vgpu
+
+		mig, err := nvmlDevice(gpu).isMigCapable()
+		if err != nil {
+			log.Printf("Unable to query MIG mode of GPU with index '%v', disabling MIG support: %v", i, err)
+			mig = false
+		}
+		caps.mig = caps.mig || mig
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	caps.topology = probeTopology(uuids, gpuallocator.NewDevicesFrom)
+
+	return caps, nil
+}
+
+// probeTopology checks whether the links between the GPUs with the given UUIDs can be queried through 'topology'.
+// The aligned allocation queries the same links (including NVLinks, which are not supported on vGPUs), so it is
+// only used if this succeeds. Topology only needs to be queried when there is more than one GPU to align.
+func probeTopology(uuids []string, topology TopologyFunc) bool {
+	if len(uuids) < 2 {
+		return true
+	}
+	_, err := topology(uuids)
+	if err != nil {
+		log.Printf("Unable to query GPU topology, disabling aligned allocation: %v", err)
+		return false
+	}
+	return true
+}
+
+// String returns a human-readable summary of the capabilities.
+func (c *capabilities) String() string {
+	return fmt.Sprintf("vgpu=%v, topology=%v, mig=%v", c.vgpu, c.topology, c.mig)
+}
@@ -0,0 +1,88 @@
+/*
+*
+# Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+*
+*/
+package rm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeTopology(t *testing.T) {
+	working := func(uuids []string) ([]*gpuallocator.Device, error) {
+		return nil, nil
+	}
+	failing := func(uuids []string) ([]*gpuallocator.Device, error) {
+		return nil, fmt.Errorf("error getting NVLink for devices (0, 1): Not Supported")
+	}
+
+	testCases := []struct {
+		uuids    []string
+		topology TopologyFunc
+		expected bool
+	}{
+		{
+			uuids:    nil,
+			topology: failing,
+			expected: true,
+		},
+		{
+			uuids:    []string{"GPU-0"},
+			topology: failing,
+			expected: true,
+		},
+		{
+			uuids:    []string{"GPU-0", "GPU-1"},
+			topology: working,
+			expected: true,
+		},
+		{
+			uuids:    []string{"GPU-0", "GPU-1"},
+			topology: failing,
+			expected: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.expected, probeTopology(tc.uuids, tc.topology))
+		})
+	}
+}
+
+func TestAlignedAllocationFallsBackToStandard(t *testing.T) {
+	r := &resourceManager{
+		config:   &spec.Config{},
+		resource: "nvidia.com/gpu",
+		devices:  newTestDevices("0", "1", "2"),
+		caps:     &capabilities{topology: true},
+		topology: func(uuids []string) ([]*gpuallocator.Device, error) {
+			return nil, fmt.Errorf("error getting NVLink for devices (0, 1): Not Supported")
+		},
+	}
+
+	devices, decision, err := r.getPreferredAllocation([]string{"GPU-0", "GPU-1", "GPU-2"}, []string{"GPU-2"}, 2)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Equal(t, "GPU-2", devices[0])
+	require.Equal(t, AllocationStrategyStandard, decision.Strategy)
+	require.Contains(t, decision.Reason, "aligned allocation failed")
+}
@@ -18,6 +18,7 @@ package rm
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -30,8 +31,11 @@ import (
 // Device wraps pluginapi.Device with extra metadata and functions.
 type Device struct {
 	pluginapi.Device
-	Paths []string
-	Index string
+	Paths       []string
+	Index       string
+	VGPUProfile string
+	// BusID is the PCI bus ID of the device (of its parent GPU for MIG devices)
+	BusID string
 }
 
 // Devices wraps a map[string]*Device with some functions.
@@ -110,6 +114,15 @@ func (ds Devices) GetIDs() []string {
 	return res
 }
 
+// GetIDsSortedByIndex returns the ids from all devices in the Devices, ordered by device index
+func (ds Devices) GetIDsSortedByIndex() []string {
+	res := ds.GetIDs()
+	sort.Slice(res, func(i, j int) bool {
+		return indexLess(ds[res[i]].Index, ds[res[j]].Index)
+	})
+	return res
+}
+
 // GetPluginDevices returns the plugin Devices from all devices in the Devices
 func (ds Devices) GetPluginDevices() []*pluginapi.Device {
 	var res []*pluginapi.Device
@@ -137,6 +150,26 @@ func (ds Devices) GetPaths() []string {
 	return res
 }
 
+// indexLess compares two GPU indices (e.g. '1') or MIG indices (e.g. '1:0') numerically
+func indexLess(a, b string) bool {
+	as := strings.Split(a, ":")
+	bs := strings.Split(b, ":")
+	for k := 0; k < len(as) && k < len(bs); k++ {
+		ai, aerr := strconv.Atoi(as[k])
+		bi, berr := strconv.Atoi(bs[k])
+		if aerr != nil || berr != nil {
+			if as[k] != bs[k] {
+				return as[k] < bs[k]
+			}
+			continue
+		}
+		if ai != bi {
+			return ai < bi
+		}
+	}
+	return len(as) < len(bs)
+}
+
 // IsMigDevice returns checks whether d is a MIG device or not.
 func (d Device) IsMigDevice() bool {
 	return strings.Contains(d.Index, ":")
@@ -192,28 +225,28 @@ func (rs AnnotatedIDs) GetIDs() []string {
 }
 
 // buildDeviceMap builds a map of resource names to devices
-func buildDeviceMap(config *spec.Config) (map[spec.ResourceName]Devices, error) {
-	devices, err := buildDeviceMapFromConfigResources(config)
+func buildDeviceMap(config *spec.Config, caps *capabilities) (map[spec.ResourceName]Devices, error) {
+	devices, err := buildDeviceMapFromConfigResources(config, caps)
 	if err != nil {
 		return nil, fmt.Errorf("error building device map from config.resources: %v", err)
 	}
 	devices, err = updateDeviceMapWithReplicas(config, devices)
 	if err != nil {
-		return nil, fmt.Errorf("error updating device map with replicas from config.sharing.timeSlicing.resources: %v", err)
+		return nil, fmt.Errorf("error updating device map with replicas from config.sharing: %v", err)
 	}
 	return devices, nil
 }
 
 // buildDeviceMapFromConfigResources builds a map of resource names to devices from spec.Config.Resources
-func buildDeviceMapFromConfigResources(config *spec.Config) (map[spec.ResourceName]Devices, error) {
+func buildDeviceMapFromConfigResources(config *spec.Config, caps *capabilities) (map[spec.ResourceName]Devices, error) {
 	devices := make(map[spec.ResourceName]Devices)
 
-	err := buildGPUDeviceMap(config, devices)
+	err := buildGPUDeviceMap(config, caps, devices)
 	if err != nil {
 		return nil, fmt.Errorf("error building GPU device map: %v", err)
 	}
 
-	if *config.Flags.MigStrategy == spec.MigStrategyNone {
+	if *config.Flags.MigStrategy == spec.MigStrategyNone || !caps.mig {
 		return devices, nil
 	}
 
@@ -226,21 +259,31 @@ func buildDeviceMapFromConfigResources(config *spec.Config) (map[spec.ResourceNa
 }
 
 // buildGPUDeviceMap builds a map of resource names to GPU devices
-func buildGPUDeviceMap(config *spec.Config, devices map[spec.ResourceName]Devices) error {
+func buildGPUDeviceMap(config *spec.Config, caps *capabilities, devices map[spec.ResourceName]Devices) error {
 	return walkGPUDevices(func(i int, gpu nvml.Device) error {
 		name, ret := gpu.GetName()
 		if ret != nvml.SUCCESS {
 			return fmt.Errorf("error getting product name for GPU with index '%v': %v", i, nvml.ErrorString(ret))
 		}
-		migEnabled, err := nvmlDevice(gpu).isMigEnabled()
-		if err != nil {
-			return fmt.Errorf("error checking if MIG is enabled on GPU with index '%v': %v", i, err)
+		if caps.mig {
+			migEnabled, err := nvmlDevice(gpu).isMigEnabled()
+			if err != nil {
+				return fmt.Errorf("error checking if MIG is enabled on GPU with index '%v': %v", i, err)
+			}
+			if migEnabled && *config.Flags.MigStrategy != spec.MigStrategyNone {
+				return nil
+			}
 		}
-		if migEnabled && *config.Flags.MigStrategy != spec.MigStrategyNone {
-			return nil
+		uuid, ret := gpu.GetUUID()
+		if ret != nvml.SUCCESS {
+			return fmt.Errorf("error getting UUID for GPU with index '%v': %v", i, nvml.ErrorString(ret))
+		}
+		busID, err := nvmlDevice(gpu).getPciBusID()
+		if err != nil {
+			return fmt.Errorf("error getting PCI bus ID for GPU with index '%v': %v", i, err)
 		}
 		for _, resource := range config.Resources.GPUs {
-			if resource.Pattern.Matches(name) {
+			if resource.Pattern.MatchesGPU(name, uuid, busID) {
 				return setGPUDeviceMapEntry(i, gpu, &resource, devices)
 			}
 		}
@@ -302,15 +345,27 @@ func buildDevice(index string, d nvml.Device) (*Device, error) {
 		return nil, fmt.Errorf("error getting device paths: %v", err)
 	}
 
+	busID, err := nvmlDevice(d).getGPUPciBusID()
+	if err != nil {
+		return nil, fmt.Errorf("error getting device PCI bus ID: %v", err)
+	}
+
 	numa, err := nvmlDevice(d).getNumaNode()
 	if err != nil {
 		return nil, fmt.Errorf("error getting device NUMA node: %v", err)
 	}
 
+	vgpuProfile, err := nvmlDevice(d).getVGPUProfile()
+	if err != nil {
+		return nil, fmt.Errorf("error getting vGPU profile: %v", err)
+	}
+
 	dev := Device{}
 	dev.ID = uuid
 	dev.Index = index
 	dev.Paths = paths
+	dev.VGPUProfile = vgpuProfile
+	dev.BusID = busID
 	dev.Health = pluginapi.Healthy
 	if numa != nil {
 		dev.Topology = &pluginapi.TopologyInfo{
@@ -325,7 +380,8 @@ func buildDevice(index string, d nvml.Device) (*Device, error) {
 	return &dev, nil
 }
 
-// updateDeviceMapWithReplicas returns an updated map of resource names to devices with replica information from spec.Config.Sharing.TimeSlicing.Resources
+// updateDeviceMapWithReplicas returns an updated map of resource names to devices with replica information from
+// spec.Config.Sharing.TimeSlicing.Resources and spec.Config.Sharing.MPS.Resources
 func updateDeviceMapWithReplicas(config *spec.Config, oDevices map[spec.ResourceName]Devices) (map[spec.ResourceName]Devices, error) {
 	devices := make(map[spec.ResourceName]Devices)
 
@@ -335,6 +391,22 @@ func updateDeviceMapWithReplicas(config *spec.Config, oDevices map[spec.Resource
 		names[r.Name] = true
 	}
 
+	// Add the resource names from config.Sharing.MPS.Resources and config.Sharing.Fractional.Resources,
+	// making sure no resource is shared by more than one strategy.
+	var shared []spec.ReplicatedResource
+	shared = append(shared, config.Sharing.MPSResources()...)
+	shared = append(shared, config.Sharing.FractionalResources()...)
+	for _, r := range shared {
+		if names[r.Name] {
+			return nil, fmt.Errorf("resource '%v' cannot be shared by more than one of time-slicing, MPS, and fractions", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	var replicated []spec.ReplicatedResource
+	replicated = append(replicated, config.Sharing.TimeSlicing.Resources...)
+	replicated = append(replicated, shared...)
+
 	// Copy over all devices from oDevices without a resource reference in TimeSlicing.Resources.
 	for r, ds := range oDevices {
 		if !names[r] {
@@ -342,8 +414,8 @@ func updateDeviceMapWithReplicas(config *spec.Config, oDevices map[spec.Resource
 		}
 	}
 
-	// Walk TimeSlicing.Resources and update devices in the device map as appropriate.
-	for _, r := range config.Sharing.TimeSlicing.Resources {
+	// Walk all replicated resources and update devices in the device map as appropriate.
+	for _, r := range replicated {
 		// Skip any resources not matched in oDevices
 		if _, exists := oDevices[r.Name]; !exists {
 			continue
@@ -391,11 +463,12 @@ func getIDsOfDevicesToReplicate(r *spec.ReplicatedResource, devices Devices) ([]
 	}
 
 	// If a specific number of devices for this resource type are to be replicated.
+	// Pick them in index order so the same devices are replicated every time.
 	if r.Devices.Count > 0 {
 		if r.Devices.Count > len(devices) {
 			return nil, fmt.Errorf("requested %d devices to be replicated, but only %d devices available", r.Devices.Count, len(devices))
 		}
-		return devices.GetIDs()[:r.Devices.Count], nil
+		return devices.GetIDsSortedByIndex()[:r.Devices.Count], nil
 	}
 
 	// If a specific set of devices for this resource type are to be replicated.
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDevices(indices ...string) Devices {
+	devices := make(Devices)
+	for _, index := range indices {
+		d := &Device{Index: index}
+		d.ID = "GPU-" + index
+		devices[d.ID] = d
+	}
+	return devices
+}
+
+func TestGetIDsSortedByIndex(t *testing.T) {
+	testCases := []struct {
+		devices  Devices
+		expected []string
+	}{
+		{
+			devices: newTestDevices(),
+		},
+		{
+			devices:  newTestDevices("2", "0", "1"),
+			expected: []string{"GPU-0", "GPU-1", "GPU-2"},
+		},
+		{
+			devices:  newTestDevices("10", "9", "1"),
+			expected: []string{"GPU-1", "GPU-9", "GPU-10"},
+		},
+		{
+			devices:  newTestDevices("1:10", "1:2", "0:3"),
+			expected: []string{"GPU-0:3", "GPU-1:2", "GPU-1:10"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.devices.GetIDsSortedByIndex())
+		})
+	}
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fake
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// Fixture describes a set of simulated GPUs and the NVLinks between them.
+type Fixture struct {
+	GPUs    []GPU    `json:"gpus"`
+	NVLinks []NVLink `json:"nvlinks,omitempty"`
+}
+
+// GPU describes one or more identical simulated GPUs.
+// If any MIG devices are listed, the GPUs are treated as having MIG mode enabled.
+type GPU struct {
+	Product    string   `json:"product"`
+	Count      int      `json:"count,omitempty"`
+	MemoryMiB  uint64   `json:"memory,omitempty"`
+	NUMANode   *int     `json:"numaNode,omitempty"`
+	MigDevices []string `json:"migDevices,omitempty"`
+}
+
+// NVLink connects the two GPUs with the given indices with a number of NVLinks.
+type NVLink struct {
+	GPUs  [2]int `json:"gpus"`
+	Links int    `json:"links,omitempty"`
+}
+
+// gpu is a single simulated GPU after expanding the counts in a Fixture.
+type gpu struct {
+	*GPU
+	index int
+}
+
+// LoadFixture reads a Fixture from the YAML file at the specified path.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixture: %v", err)
+	}
+
+	var f Fixture
+	err = yaml.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fixture: %v", err)
+	}
+
+	count := len(f.gpus())
+	for _, l := range f.NVLinks {
+		for _, i := range l.GPUs {
+			if i < 0 || i >= count {
+				return nil, fmt.Errorf("NVLink references GPU %d but the fixture only has %d GPUs", i, count)
+			}
+		}
+		if l.GPUs[0] == l.GPUs[1] {
+			return nil, fmt.Errorf("NVLink must connect two different GPUs: %v", l.GPUs)
+		}
+	}
+
+	return &f, nil
+}
+
+// AddDefaultResourcesToConfig adds default resource matching rules for the simulated devices to config.Resources.
+// This mirrors rm.AddDefaultResourcesToConfig, taking the MIG profiles from the Fixture instead of NVML.
+func (f *Fixture) AddDefaultResourcesToConfig(config *spec.Config) error {
+	config.Resources.AddGPUResource("*", "gpu")
+	switch *config.Flags.MigStrategy {
+	case spec.MigStrategySingle:
+		return config.Resources.AddMIGResource("*", "gpu")
+	case spec.MigStrategyMixed:
+		visited := make(map[string]bool)
+		for _, g := range f.GPUs {
+			for _, p := range g.MigDevices {
+				if visited[p] {
+					continue
+				}
+				err := config.Resources.AddMIGResource(p, "mig-"+p)
+				if err != nil {
+					return err
+				}
+				visited[p] = true
+			}
+		}
+	}
+	return nil
+}
+
+// NewResourceManagers returns a []ResourceManager serving the simulated devices, one for each resource in 'config'.
+func (f *Fixture) NewResourceManagers(config *spec.Config) ([]rm.ResourceManager, error) {
+	deviceMap, err := f.buildDeviceMap(config)
+	if err != nil {
+		return nil, fmt.Errorf("error building device map: %v", err)
+	}
+	return rm.NewSimulatedResourceManagers(config, deviceMap, f.topology())
+}
+
+// buildDeviceMap builds a map of resource names to simulated devices, following the same rules as for real devices.
+func (f *Fixture) buildDeviceMap(config *spec.Config) (map[spec.ResourceName]rm.Devices, error) {
+	devices := make(map[spec.ResourceName]rm.Devices)
+	add := func(name spec.ResourceName, d *rm.Device) {
+		if devices[name] == nil {
+			devices[name] = make(rm.Devices)
+		}
+		devices[name][d.ID] = d
+	}
+
+	migStrategy := *config.Flags.MigStrategy
+	for _, g := range f.gpus() {
+		if len(g.MigDevices) > 0 && migStrategy != spec.MigStrategyNone {
+			continue
+		}
+		resource, err := matchGPUResource(config.Resources.GPUs, g.Product, gpuUUID(g.index), busID(g.index))
+		if err != nil {
+			return nil, fmt.Errorf("error matching GPU with index '%v': %v", g.index, err)
+		}
+		add(resource, g.device(fmt.Sprintf("%v", g.index), gpuUUID(g.index)))
+	}
+
+	if migStrategy == spec.MigStrategyNone {
+		return devices, nil
+	}
+
+	for _, g := range f.gpus() {
+		for j, profile := range g.MigDevices {
+			resource, err := matchResource(config.Resources.MIGs, profile)
+			if err != nil {
+				return nil, fmt.Errorf("error matching MIG device at index '(%v, %v)': %v", g.index, j, err)
+			}
+			add(resource, g.device(fmt.Sprintf("%v:%v", g.index, j), migUUID(g.index, j)))
+		}
+	}
+
+	return devices, nil
+}
+
+// topology returns an rm.TopologyFunc over the simulated GPUs.
+// GPUs are linked by the NVLinks in the Fixture, and through PCIe on the same or across NUMA nodes.
+func (f *Fixture) topology() rm.TopologyFunc {
+	gpus := f.gpus()
+
+	devices := make(map[string]*gpuallocator.Device)
+	var ordered []*gpuallocator.Device
+	for _, g := range gpus {
+		model := g.Product
+		memory := g.MemoryMiB
+		d := &gpuallocator.Device{
+			Device: &nvml.Device{
+				UUID:   gpuUUID(g.index),
+				Path:   devicePath(g.index),
+				Model:  &model,
+				Memory: &memory,
+				PCI:    nvml.PCIInfo{BusID: busID(g.index)},
+			},
+			Index: g.index,
+			Links: make(map[int][]gpuallocator.P2PLink),
+		}
+		devices[d.UUID] = d
+		ordered = append(ordered, d)
+	}
+
+	link := func(i, j int, t nvml.P2PLinkType) {
+		ordered[i].Links[j] = append(ordered[i].Links[j], gpuallocator.P2PLink{GPU: ordered[j], Type: t})
+		ordered[j].Links[i] = append(ordered[j].Links[i], gpuallocator.P2PLink{GPU: ordered[i], Type: t})
+	}
+
+	for i := range gpus {
+		for j := i + 1; j < len(gpus); j++ {
+			if sameNUMANode(gpus[i], gpus[j]) {
+				link(i, j, nvml.P2PLinkSameCPU)
+			} else {
+				link(i, j, nvml.P2PLinkCrossCPU)
+			}
+		}
+	}
+
+	for _, l := range f.NVLinks {
+		links := l.Links
+		if links < 1 {
+			links = 1
+		}
+		if links > int(nvml.TwelveNVLINKLinks-nvml.SingleNVLINKLink)+1 {
+			links = int(nvml.TwelveNVLINKLinks-nvml.SingleNVLINKLink) + 1
+		}
+		link(l.GPUs[0], l.GPUs[1], nvml.SingleNVLINKLink+nvml.P2PLinkType(links-1))
+	}
+
+	return func(uuids []string) ([]*gpuallocator.Device, error) {
+		var filtered []*gpuallocator.Device
+		for _, uuid := range uuids {
+			d, exists := devices[uuid]
+			if !exists {
+				return nil, fmt.Errorf("no device with uuid: %v", uuid)
+			}
+			filtered = append(filtered, d)
+		}
+		return filtered, nil
+	}
+}
+
+// gpus expands the GPUs in the Fixture into individual GPUs.
+func (f *Fixture) gpus() []gpu {
+	var gpus []gpu
+	for i := range f.GPUs {
+		count := f.GPUs[i].Count
+		if count == 0 {
+			count = 1
+		}
+		for c := 0; c < count; c++ {
+			gpus = append(gpus, gpu{&f.GPUs[i], len(gpus)})
+		}
+	}
+	return gpus
+}
+
+// device builds an rm.Device with the given index and ID backed by the simulated GPU g.
+func (g gpu) device(index string, id string) *rm.Device {
+	d := &rm.Device{}
+	d.ID = id
+	d.Index = index
+	d.Paths = []string{devicePath(g.index)}
+	d.BusID = busID(g.index)
+	d.Health = pluginapi.Healthy
+	if g.NUMANode != nil {
+		d.Topology = &pluginapi.TopologyInfo{
+			Nodes: []*pluginapi.NUMANode{
+				{
+					ID: int64(*g.NUMANode),
+				},
+			},
+		}
+	}
+	return d
+}
+
+// matchGPUResource returns the name of the first resource whose pattern matches the GPU with the given product name,
+// UUID and PCI bus ID.
+func matchGPUResource(resources []spec.Resource, name, uuid, busID string) (spec.ResourceName, error) {
+	for _, r := range resources {
+		if r.Pattern.MatchesGPU(name, uuid, busID) {
+			return r.Name, nil
+		}
+	}
+	return "", fmt.Errorf("GPU name '%v' does not match any resource patterns", name)
+}
+
+// matchResource returns the name of the first resource whose pattern matches 'value'.
+func matchResource(resources []spec.Resource, value string) (spec.ResourceName, error) {
+	for _, r := range resources {
+		if r.Pattern.Matches(value) {
+			return r.Name, nil
+		}
+	}
+	return "", fmt.Errorf("'%v' does not match any resource patterns", value)
+}
+
+// sameNUMANode checks if two GPUs are attached to the same NUMA node.
+func sameNUMANode(a, b gpu) bool {
+	if a.NUMANode == nil || b.NUMANode == nil {
+		return a.NUMANode == b.NUMANode
+	}
+	return *a.NUMANode == *b.NUMANode
+}
+
+// gpuUUID returns the UUID of the simulated GPU with index i.
+func gpuUUID(i int) string {
+	return fmt.Sprintf("GPU-%08x-0000-0000-0000-000000000000", i)
+}
+
+// migUUID returns the UUID of the simulated MIG device j on the GPU with index i.
+func migUUID(i, j int) string {
+	return fmt.Sprintf("MIG-%08x-%04x-0000-0000-000000000000", i, j)
+}
+
+// busID returns the PCI bus ID of the simulated GPU with index i in the same format as used under /sys/bus/pci/devices.
+// The index is spread over the bus, device and domain fields so that every index up to 2^29 gets a distinct, valid
+// bus ID: the first 256 GPUs are on buses 00-ff of device 00, the next 256 on device 01, and so on.
+func busID(i int) string {
+	const buses, devices = 256, 32
+	bus := i % buses
+	device := (i / buses) % devices
+	domain := i / (buses * devices)
+	return fmt.Sprintf("%04x:%02x:%02x.0", domain, bus, device)
+}
+
+// devicePath returns the device node of the simulated GPU with index i.
+func devicePath(i int) string {
+	return fmt.Sprintf("/dev/nvidia%d", i)
+}
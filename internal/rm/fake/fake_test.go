@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fake
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/NVIDIA/k8s-device-plugin/internal/pairing"
+	"github.com/NVIDIA/k8s-device-plugin/internal/rm"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+// dgxFixture has 8 GPUs in two NVLink islands of 4 GPUs, one per NUMA node.
+const dgxFixture = `
+gpus:
+- product: Tesla V100-SXM2-16GB
+  memory: 16384
+  count: 4
+  numaNode: 0
+- product: Tesla V100-SXM2-16GB
+  memory: 16384
+  count: 4
+  numaNode: 1
+nvlinks:
+- {gpus: [0, 1], links: 2}
+- {gpus: [0, 2], links: 2}
+- {gpus: [0, 3], links: 2}
+- {gpus: [1, 2], links: 2}
+- {gpus: [1, 3], links: 2}
+- {gpus: [2, 3], links: 2}
+- {gpus: [4, 5], links: 2}
+- {gpus: [4, 6], links: 2}
+- {gpus: [4, 7], links: 2}
+- {gpus: [5, 6], links: 2}
+- {gpus: [5, 7], links: 2}
+- {gpus: [6, 7], links: 2}
+`
+
+const migFixture = `
+gpus:
+- product: A100-SXM4-40GB
+  memory: 40960
+  migDevices: [3g.20gb, 2g.10gb, 1g.5gb, 1g.5gb]
+- product: A100-SXM4-40GB
+  memory: 40960
+`
+
+func newTestResourceManagers(t testing.TB, fixture string, migStrategy string, config string) map[spec.ResourceName]rm.ResourceManager {
+	path := filepath.Join(t.TempDir(), "fixture.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(fixture), 0644))
+
+	f, err := LoadFixture(path)
+	require.NoError(t, err)
+
+	var c spec.Config
+	require.NoError(t, yaml.Unmarshal([]byte(config), &c))
+	c.Flags.MigStrategy = &migStrategy
+	require.NoError(t, f.AddDefaultResourcesToConfig(&c))
+
+	rms, err := f.NewResourceManagers(&c)
+	require.NoError(t, err)
+
+	res := make(map[spec.ResourceName]rm.ResourceManager)
+	for _, r := range rms {
+		res[r.Resource()] = r
+	}
+	return res
+}
+
+func TestAlignedAllocation(t *testing.T) {
+	rms := newTestResourceManagers(t, dgxFixture, spec.MigStrategyNone, "version: v1")
+	require.Len(t, rms, 1)
+
+	r := rms["nvidia.com/gpu"]
+	require.Len(t, r.Devices(), 8)
+	available := r.Devices().GetIDs()
+
+	island := func(ids []string) []string {
+		var indices []string
+		for _, id := range ids {
+			indices = append(indices, r.Devices()[id].Index)
+		}
+		sort.Strings(indices)
+		return indices
+	}
+
+	devices, err := r.GetPreferredAllocation(available, nil, 4)
+	require.NoError(t, err)
+	require.Contains(t, [][]string{{"0", "1", "2", "3"}, {"4", "5", "6", "7"}}, island(devices))
+
+	devices, err = r.GetPreferredAllocation(available, []string{gpuUUID(5)}, 2)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Contains(t, devices, gpuUUID(5))
+	for _, index := range island(devices) {
+		require.Contains(t, []string{"4", "5", "6", "7"}, index)
+	}
+}
+
+func TestExplainAlignedAllocation(t *testing.T) {
+	rms := newTestResourceManagers(t, dgxFixture, spec.MigStrategyNone, "version: v1")
+	r := rms["nvidia.com/gpu"]
+
+	devices, decision, err := r.ExplainPreferredAllocation(r.Devices().GetIDs(), []string{gpuUUID(0)}, 2)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Equal(t, rm.AllocationStrategyAligned, decision.Strategy)
+	require.Len(t, decision.Links, 1)
+	require.ElementsMatch(t, devices, decision.Links[0].Devices[:])
+	require.NotEmpty(t, decision.Links[0].Links)
+}
+
+func TestMigDevices(t *testing.T) {
+	testCases := []struct {
+		migStrategy string
+		expected    map[spec.ResourceName]int
+	}{
+		{
+			migStrategy: spec.MigStrategyNone,
+			expected: map[spec.ResourceName]int{
+				"nvidia.com/gpu": 2,
+			},
+		},
+		{
+			migStrategy: spec.MigStrategyMixed,
+			expected: map[spec.ResourceName]int{
+				"nvidia.com/gpu":         1,
+				"nvidia.com/mig-3g.20gb": 1,
+				"nvidia.com/mig-2g.10gb": 1,
+				"nvidia.com/mig-1g.5gb":  2,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.migStrategy, func(t *testing.T) {
+			rms := newTestResourceManagers(t, migFixture, tc.migStrategy, "version: v1")
+			counts := make(map[spec.ResourceName]int)
+			for name, r := range rms {
+				counts[name] = len(r.Devices())
+			}
+			require.Equal(t, tc.expected, counts)
+		})
+	}
+}
+
+const replicasConfig = `
+version: v1
+sharing:
+  timeSlicing:
+    resources:
+    - name: nvidia.com/gpu
+      replicas: 1280
+`
+
+func TestAllocationAtScale(t *testing.T) {
+	rms := newTestResourceManagers(t, dgxFixture, spec.MigStrategyNone, replicasConfig)
+	r := rms["nvidia.com/gpu"]
+	require.Len(t, r.Devices(), 8*1280)
+
+	available := r.Devices().GetIDs()
+	original := append([]string{}, available...)
+	required := []string{available[0], available[1]}
+	devices, err := r.GetPreferredAllocation(available, required, 16)
+	require.NoError(t, err)
+	require.Len(t, devices, 16)
+	require.Subset(t, devices, required)
+	require.Subset(t, available, devices)
+	require.Equal(t, original, available)
+}
+
+func TestPairingWithSimulatedGPUs(t *testing.T) {
+	rms := newTestResourceManagers(t, dgxFixture, spec.MigStrategyNone, "version: v1\n")
+	r := rms["nvidia.com/gpu"]
+
+	// Put every simulated GPU below one root port, with a single RDMA NIC next to them.
+	sysfs := t.TempDir()
+	link := func(busID string) string {
+		dir := filepath.Join(sysfs, "devices", "pci0000:00", "0000:00:01.0", busID)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		l := filepath.Join(sysfs, "bus", "pci", "devices", busID)
+		require.NoError(t, os.MkdirAll(filepath.Dir(l), 0755))
+		require.NoError(t, os.Symlink(dir, l))
+		return l
+	}
+	var gpus []pairing.GPU
+	for _, d := range r.Devices() {
+		require.Regexp(t, `^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`, d.BusID)
+		link(d.BusID)
+		gpus = append(gpus, pairing.GPU{ID: d.ID, BusID: d.BusID})
+	}
+	nic := filepath.Join(sysfs, "class", "infiniband", "mlx5_0")
+	require.NoError(t, os.MkdirAll(nic, 0755))
+	require.NoError(t, os.Symlink(link("0000:c0:00.0"), filepath.Join(nic, "device")))
+
+	hints, err := pairing.Discover(sysfs, gpus)
+	require.NoError(t, err)
+	require.Len(t, hints.Pairs, len(gpus))
+	for _, p := range hints.Pairs {
+		require.Equal(t, "mlx5_0", p.NIC)
+		require.Equal(t, "0000:c0:00.0", p.NICBusID)
+		require.True(t, p.SameSwitch)
+	}
+}
+
+func TestBusIDs(t *testing.T) {
+	seen := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		id := busID(i)
+
+		var domain, bus, device, function int
+		_, err := fmt.Sscanf(id, "%04x:%02x:%02x.%x", &domain, &bus, &device, &function)
+		require.NoError(t, err, "index %d", i)
+		require.Regexp(t, `^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`, id, "index %d", i)
+		require.Less(t, device, 32, "index %d", i)
+
+		other, exists := seen[id]
+		require.False(t, exists, "indices %d and %d share bus ID %v", other, i, id)
+		seen[id] = i
+	}
+
+	require.Equal(t, "0000:07:00.0", busID(7))
+	require.Equal(t, "0000:00:01.0", busID(256))
+	require.Equal(t, "0001:00:00.0", busID(256*32))
+}
+
+func BenchmarkAllocationAtScale(b *testing.B) {
+	rms := newTestResourceManagers(b, dgxFixture, spec.MigStrategyNone, replicasConfig)
+	r := rms["nvidia.com/gpu"]
+	available := r.Devices().GetIDs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := r.GetPreferredAllocation(available, nil, 8)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
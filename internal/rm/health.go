@@ -22,6 +22,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NVIDIA/k8s-device-plugin/internal/mig"
 )
@@ -36,7 +37,8 @@ const (
 )
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
-func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices, unhealthy chan<- *Device) error {
+// and to the 'healthy' channel with any unhealthy devices that pass a recovery probe after the configured cooldown
+func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices, unhealthy chan<- *Device, healthy chan<- *Device) error {
 	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
 	if disableHealthChecks == "all" {
 		disableHealthChecks = allHealthChecks
@@ -56,9 +58,18 @@ func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices,
 		68, // Video processor exception
 	}
 
+	// If the config lists the Xids that mark a device unhealthy explicitly,
+	// only those are considered and application errors are no longer skipped.
+	unhealthyXids := make(map[uint64]bool)
+	for _, id := range r.config.Health.Xids {
+		unhealthyXids[id] = true
+	}
+
 	skippedXids := make(map[uint64]bool)
-	for _, id := range applicationErrorXids {
-		skippedXids[id] = true
+	if len(unhealthyXids) == 0 {
+		for _, id := range applicationErrorXids {
+			skippedXids[id] = true
+		}
 	}
 
 	for _, additionalXid := range getAdditionalXids(disableHealthChecks) {
@@ -68,13 +79,14 @@ func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices,
 	eventSet := nvmlNewEventSet()
 	defer nvmlDeleteEventSet(eventSet)
 
+	registered := make(map[string]bool)
 	for _, d := range devices {
-		gpu, _, _, err := mig.GetMigDevicePartsByUUID(d.ID)
-		if err != nil {
-			gpu = d.ID
+		gpu := getParentGPUUUID(d)
+		if registered[gpu] {
+			continue
 		}
 
-		err = nvmlRegisterEventForDevice(eventSet, nvmlXidCriticalError, gpu)
+		err := nvmlRegisterEventForDevice(eventSet, nvmlXidCriticalError, gpu)
 		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
 			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", d.ID, err)
 			unhealthy <- d
@@ -83,8 +95,23 @@ func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices,
 		if err != nil {
 			return fmt.Errorf("unable to register events for health checking on GPU %v: %v", gpu, err)
 		}
+		registered[gpu] = true
 	}
 
+	// Track devices marked unhealthy by an Xid so they can be probed for recovery once a cooldown is configured.
+	var cooldown time.Duration
+	if r.config.Health.RecoveryCooldown != nil {
+		cooldown = time.Duration(*r.config.Health.RecoveryCooldown)
+	}
+	unhealthySince := make(map[*Device]time.Time)
+	markUnhealthy := func(d *Device) {
+		unhealthy <- d
+		unhealthySince[d] = time.Now()
+	}
+
+	// Track vGPUs without a license, these are unhealthy until a license is acquired.
+	unlicensed := make(map[string]bool)
+
 	for {
 		select {
 		case <-stop:
@@ -92,6 +119,14 @@ func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices,
 		default:
 		}
 
+		if r.caps.vgpu {
+			checkLicenses(devices, nvmlIsLicensed, unlicensed, unhealthySince, unhealthy, healthy)
+		}
+
+		if cooldown != 0 {
+			probeRecovery(nvmlProbeDevice, cooldown, unlicensed, unhealthySince, healthy)
+		}
+
 		e, err := nvmlWaitForEvent(eventSet, 5000)
 		if err != nil && e.Etype != nvmlXidCriticalError {
 			continue
@@ -101,11 +136,15 @@ func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices,
 			continue
 		}
 
+		if len(unhealthyXids) > 0 && !unhealthyXids[e.Edata] {
+			continue
+		}
+
 		if e.UUID == nil || len(*e.UUID) == 0 {
 			// All devices are unhealthy
 			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Edata)
 			for _, d := range devices {
-				unhealthy <- d
+				markUnhealthy(d)
 			}
 			continue
 		}
@@ -113,21 +152,104 @@ func (r *resourceManager) checkHealth(stop <-chan interface{}, devices Devices,
 		for _, d := range devices {
 			// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
 			// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
-			gpu, gi, ci, err := mig.GetMigDevicePartsByUUID(d.ID)
+			gpu, gi, ci, err := mig.GetMigDevicePartsByUUID(AnnotatedID(d.ID).GetID())
 			if err != nil {
-				gpu = d.ID
+				gpu = AnnotatedID(d.ID).GetID()
 				gi = 0xFFFFFFFF
 				ci = 0xFFFFFFFF
 			}
 
 			if gpu == *e.UUID && gi == *e.GpuInstanceID && ci == *e.ComputeInstanceID {
 				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Edata, d.ID)
+				markUnhealthy(d)
+			}
+		}
+	}
+}
+
+// probeRecovery probes the devices in 'unhealthySince' that have been unhealthy for at least 'cooldown'.
+// Devices that respond are marked healthy again, unless their vGPU is still unlicensed; these stay unhealthy
+// and are probed again once their license is reacquired.
+func probeRecovery(probe func(uuid string) error, cooldown time.Duration, unlicensed map[string]bool, unhealthySince map[*Device]time.Time, healthy chan<- *Device) {
+	for d, since := range unhealthySince {
+		if time.Since(since) < cooldown {
+			continue
+		}
+		gpu := getParentGPUUUID(d)
+		if unlicensed[gpu] {
+			continue
+		}
+		err := probe(gpu)
+		if err != nil {
+			log.Printf("Recovery probe failed for Device=%s: %v. Retrying in %v.", d.ID, err, cooldown)
+			unhealthySince[d] = time.Now()
+			continue
+		}
+		log.Printf("Recovery probe succeeded for Device=%s, the device will go healthy.", d.ID)
+		delete(unhealthySince, d)
+		healthy <- d
+	}
+}
+
+// checkLicenses checks the license state of the vGPUs backing 'devices' through 'isLicensed'.
+// Devices on vGPUs that lose their license are marked unhealthy, and marked healthy again once it is reacquired
+// (unless they have also been marked unhealthy by an Xid).
+func checkLicenses(devices Devices, isLicensed func(uuid string) (bool, error), unlicensed map[string]bool, unhealthySince map[*Device]time.Time, unhealthy chan<- *Device, healthy chan<- *Device) {
+	licensed := make(map[string]bool)
+	for _, d := range devices {
+		if d.VGPUProfile == "" {
+			continue
+		}
+		gpu := getParentGPUUUID(d)
+		if _, checked := licensed[gpu]; !checked {
+			l, err := isLicensed(gpu)
+			if err != nil {
+				log.Printf("Unable to check license state of vGPU %s: %v", gpu, err)
+				l = !unlicensed[gpu]
+			}
+			licensed[gpu] = l
+		}
+	}
+
+	for gpu, l := range licensed {
+		if l == !unlicensed[gpu] {
+			continue
+		}
+		if l {
+			log.Printf("vGPU %s is licensed again, its devices will go healthy.", gpu)
+			delete(unlicensed, gpu)
+		} else {
+			log.Printf("vGPU %s is not licensed, its devices will go unhealthy.", gpu)
+			unlicensed[gpu] = true
+		}
+		for _, d := range devices {
+			if getParentGPUUUID(d) != gpu {
+				continue
+			}
+			if !l {
 				unhealthy <- d
+				continue
+			}
+			if _, exists := unhealthySince[d]; !exists {
+				healthy <- d
 			}
 		}
 	}
 }
 
+// getParentGPUUUID returns the UUID of the full GPU backing a device (stripping any replica annotations).
+func getParentGPUUUID(d *Device) string {
+	id := AnnotatedID(d.ID).GetID()
+	if !d.IsMigDevice() {
+		return id
+	}
+	gpu, _, _, err := mig.GetMigDevicePartsByUUID(id)
+	if err != nil {
+		return id
+	}
+	return gpu
+}
+
 // getAdditionalXids returns a list of additional Xids to skip from the specified string.
 // The input is treaded as a comma-separated string and all valid uint64 values are considered as Xid values. Invalid values
 // are ignored.
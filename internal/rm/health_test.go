@@ -19,6 +19,7 @@ package rm
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -72,3 +73,158 @@ func TestGetAdditionalXids(t *testing.T) {
 		})
 	}
 }
+
+// drain returns the IDs of all devices sent to 'c' so far.
+func drain(c chan *Device) []string {
+	var ids []string
+	for {
+		select {
+		case d := <-c:
+			ids = append(ids, d.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func newTestVGPUs(ids ...string) Devices {
+	devices := make(Devices)
+	for _, id := range ids {
+		d := &Device{VGPUProfile: "GRID T4-4C"}
+		d.ID = id
+		devices[id] = d
+	}
+	return devices
+}
+
+func TestCheckLicenses(t *testing.T) {
+	testCases := []struct {
+		description     string
+		licensed        map[string]bool
+		err             error
+		unlicensed      map[string]bool
+		unhealthyByXid  []string
+		unhealthy       []string
+		healthy         []string
+		stillUnlicensed []string
+	}{
+		{
+			description: "licensed vGPU stays healthy",
+			licensed:    map[string]bool{"GPU-0": true},
+			unlicensed:  map[string]bool{},
+		},
+		{
+			description:     "vGPU losing its license goes unhealthy",
+			licensed:        map[string]bool{"GPU-0": false},
+			unlicensed:      map[string]bool{},
+			unhealthy:       []string{"GPU-0"},
+			stillUnlicensed: []string{"GPU-0"},
+		},
+		{
+			description:     "unlicensed vGPU is not reported again",
+			licensed:        map[string]bool{"GPU-0": false},
+			unlicensed:      map[string]bool{"GPU-0": true},
+			stillUnlicensed: []string{"GPU-0"},
+		},
+		{
+			description: "vGPU reacquiring its license goes healthy",
+			licensed:    map[string]bool{"GPU-0": true},
+			unlicensed:  map[string]bool{"GPU-0": true},
+			healthy:     []string{"GPU-0"},
+		},
+		{
+			description:    "vGPU reacquiring its license stays unhealthy after an Xid",
+			licensed:       map[string]bool{"GPU-0": true},
+			unlicensed:     map[string]bool{"GPU-0": true},
+			unhealthyByXid: []string{"GPU-0"},
+		},
+		{
+			description:     "license state is kept if it cannot be checked",
+			err:             fmt.Errorf("Unknown Error"),
+			unlicensed:      map[string]bool{"GPU-0": true},
+			stillUnlicensed: []string{"GPU-0"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			devices := newTestVGPUs("GPU-0")
+			isLicensed := func(uuid string) (bool, error) {
+				return tc.licensed[uuid], tc.err
+			}
+			unhealthySince := make(map[*Device]time.Time)
+			for _, id := range tc.unhealthyByXid {
+				unhealthySince[devices[id]] = time.Now()
+			}
+			unhealthy := make(chan *Device, len(devices))
+			healthy := make(chan *Device, len(devices))
+
+			checkLicenses(devices, isLicensed, tc.unlicensed, unhealthySince, unhealthy, healthy)
+
+			require.Equal(t, tc.unhealthy, drain(unhealthy))
+			require.Equal(t, tc.healthy, drain(healthy))
+			var unlicensed []string
+			for gpu := range tc.unlicensed {
+				unlicensed = append(unlicensed, gpu)
+			}
+			require.Equal(t, tc.stillUnlicensed, unlicensed)
+		})
+	}
+}
+
+func TestProbeRecovery(t *testing.T) {
+	const cooldown = time.Minute
+
+	testCases := []struct {
+		description string
+		since       time.Duration
+		probeErr    error
+		unlicensed  bool
+		healthy     []string
+		recovered   bool
+	}{
+		{
+			description: "device within its cooldown is not probed",
+			since:       cooldown / 2,
+		},
+		{
+			description: "device passing the probe goes healthy",
+			since:       2 * cooldown,
+			healthy:     []string{"GPU-0"},
+			recovered:   true,
+		},
+		{
+			description: "device failing the probe stays unhealthy",
+			since:       2 * cooldown,
+			probeErr:    fmt.Errorf("GPU is lost"),
+		},
+		{
+			description: "device on an unlicensed vGPU stays unhealthy",
+			since:       2 * cooldown,
+			unlicensed:  true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d: %s", i, tc.description), func(t *testing.T) {
+			devices := newTestVGPUs("GPU-0")
+			d := devices["GPU-0"]
+			unhealthySince := map[*Device]time.Time{d: time.Now().Add(-tc.since)}
+			unlicensed := map[string]bool{"GPU-0": tc.unlicensed}
+			healthy := make(chan *Device, len(devices))
+
+			probed := false
+			probe := func(uuid string) error {
+				probed = true
+				return tc.probeErr
+			}
+
+			probeRecovery(probe, cooldown, unlicensed, unhealthySince, healthy)
+
+			require.Equal(t, tc.healthy, drain(healthy))
+			_, stillUnhealthy := unhealthySince[d]
+			require.Equal(t, !tc.recovered, stillUnhealthy)
+			require.Equal(t, tc.since >= cooldown && !tc.unlicensed, probed)
+		})
+	}
+}
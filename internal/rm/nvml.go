@@ -19,6 +19,7 @@ package rm
 import (
 	"bytes"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -136,6 +137,21 @@ func nvmlRegisterEventForDevice(es nvml.EventSet, event int, uuid string) error
 	return fmt.Errorf("nvml: device not found")
 }
 
+// nvmlProbeDevice checks that the GPU with a specific UUID still responds to NVML queries.
+func nvmlProbeDevice(uuid string) error {
+	d, ret := nvml.DeviceGetHandleByUUID(uuid)
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("error getting device handle: %v", nvml.ErrorString(ret))
+	}
+
+	_, ret = d.GetMemoryInfo()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("error getting memory info: %v", nvml.ErrorString(ret))
+	}
+
+	return nil
+}
+
 // walkGPUDevices walks all of the GPU devices reported by NVML
 func walkGPUDevices(f func(i int, d nvml.Device) error) error {
 	count, ret := nvml.DeviceGetCount()
@@ -162,7 +178,9 @@ func walkMigProfiles(f func(p string) error) error {
 	return walkGPUDevices(func(i int, gpu nvml.Device) error {
 		capable, err := nvmlDevice(gpu).isMigCapable()
 		if err != nil {
-			return fmt.Errorf("error checking if GPU %v is MIG capable: %v", i, err)
+			// Some drivers (e.g. inside a VM with a vGPU) fail to report the MIG mode at all.
+			log.Printf("Unable to check if GPU %v is MIG capable, skipping its MIG profiles: %v", i, err)
+			return nil
 		}
 		if !capable {
 			return nil
@@ -362,28 +380,125 @@ func (d nvmlDevice) getPaths() ([]string, error) {
 	return paths, nil
 }
 
-// getNumaNode returns the NUMA node associated with the given device (MIG or GPU)
-func (d nvmlDevice) getNumaNode() (*int, error) {
+// getPciBusID returns the PCI bus ID of the given GPU device in the same format as used under /sys/bus/pci/devices
+func (d nvmlDevice) getPciBusID() (string, error) {
+	info, ret := nvml.Device(d).GetPciInfo()
+	if ret != nvml.SUCCESS {
+		return "", fmt.Errorf("error getting PCI Bus Info of device: %v", nvml.ErrorString(ret))
+	}
+
+	// Discard leading zeros.
+	busID := strings.ToLower(strings.TrimPrefix(int8Slice(info.BusId[:]).String(), "0000"))
+
+	return busID, nil
+}
+
+// isVGPU checks if the given GPU device is a vGPU exposed to a VM
+func (d nvmlDevice) isVGPU() (bool, error) {
+	err := nvmlLookupSymbol("nvmlDeviceGetVirtualizationMode")
+	if err != nil {
+		return false, nil
+	}
+
+	mode, ret := nvml.Device(d).GetVirtualizationMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return false, nil
+	}
+	if ret != nvml.SUCCESS {
+		return false, fmt.Errorf("error getting virtualization mode: %v", nvml.ErrorString(ret))
+	}
+
+	return (mode == nvml.GPU_VIRTUALIZATION_MODE_VGPU), nil
+}
+
+// getVGPUProfile returns the name of the vGPU profile backing the given device (or "" if it is not a vGPU).
+// Inside a VM, the product name reported for a vGPU is the name of its profile (e.g. 'GRID T4-4C').
+func (d nvmlDevice) getVGPUProfile() (string, error) {
 	isMig, err := d.isMigDevice()
 	if err != nil {
-		return nil, fmt.Errorf("error checking if device is a MIG device: %v", err)
+		return "", fmt.Errorf("error checking if device is a MIG device: %v", err)
+	}
+	if isMig {
+		return "", nil
+	}
+
+	vgpu, err := d.isVGPU()
+	if err != nil {
+		return "", err
+	}
+	if !vgpu {
+		return "", nil
+	}
+
+	name, ret := nvml.Device(d).GetName()
+	if ret != nvml.SUCCESS {
+		return "", fmt.Errorf("error getting product name: %v", nvml.ErrorString(ret))
+	}
+
+	return name, nil
+}
+
+// nvmlIsLicensed checks whether the vGPU with a specific UUID holds a license for any of its enabled features.
+// Devices that do not support licensing are always reported as licensed.
+func nvmlIsLicensed(uuid string) (bool, error) {
+	err := nvmlLookupSymbol("nvmlDeviceGetGridLicensableFeatures")
+	if err != nil {
+		return true, nil
+	}
+
+	d, ret := nvml.DeviceGetHandleByUUID(uuid)
+	if ret != nvml.SUCCESS {
+		return false, fmt.Errorf("error getting device handle: %v", nvml.ErrorString(ret))
+	}
+
+	features, ret := d.GetGridLicensableFeatures()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return true, nil
+	}
+	if ret != nvml.SUCCESS {
+		return false, fmt.Errorf("error getting licensable features: %v", nvml.ErrorString(ret))
+	}
+	if features.IsGridLicenseSupported == 0 {
+		return true, nil
+	}
+
+	count := int(features.LicensableFeaturesCount)
+	if count > len(features.GridLicensableFeatures) {
+		count = len(features.GridLicensableFeatures)
+	}
+	for _, f := range features.GridLicensableFeatures[:count] {
+		if f.FeatureEnabled != 0 && f.FeatureState != 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// getGPUPciBusID returns the PCI bus ID of the given device (of its parent GPU for MIG devices)
+func (d nvmlDevice) getGPUPciBusID() (string, error) {
+	isMig, err := d.isMigDevice()
+	if err != nil {
+		return "", fmt.Errorf("error checking if device is a MIG device: %v", err)
 	}
 
 	if isMig {
 		parent, ret := nvml.Device(d).GetDeviceHandleFromMigDeviceHandle()
 		if ret != nvml.SUCCESS {
-			return nil, fmt.Errorf("error getting parent GPU device from MIG device: %v", nvml.ErrorString(ret))
+			return "", fmt.Errorf("error getting parent GPU device from MIG device: %v", nvml.ErrorString(ret))
 		}
 		d = nvmlDevice(parent)
 	}
 
-	info, ret := nvml.Device(d).GetPciInfo()
-	if ret != nvml.SUCCESS {
-		return nil, fmt.Errorf("error getting PCI Bus Info of device: %v", nvml.ErrorString(ret))
-	}
+	return d.getPciBusID()
+}
 
-	// Discard leading zeros.
-	busID := strings.ToLower(strings.TrimPrefix(int8Slice(info.BusId[:]).String(), "0000"))
+// getNumaNode returns the NUMA node associated with the given device (MIG or GPU)
+func (d nvmlDevice) getNumaNode() (*int, error) {
+	busID, err := d.getGPUPciBusID()
+	if err != nil {
+		return nil, err
+	}
 
 	b, err := os.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/numa_node", busID))
 	if err != nil {
@@ -18,7 +18,9 @@ package rm
 
 import (
 	"fmt"
+	"log"
 
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	spec "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
 )
@@ -30,6 +32,12 @@ type resourceManager struct {
 	config   *spec.Config
 	resource spec.ResourceName
 	devices  Devices
+	caps     *capabilities
+
+	// topology returns the devices used to calculate aligned allocations (gpuallocator.NewDevicesFrom if unset)
+	topology TopologyFunc
+	// simulated is set for devices that are not backed by NVML, no health checks are performed for them
+	simulated bool
 }
 
 // ResourceManager provides an interface for listing a set of Devices and checking health on them
@@ -37,15 +45,25 @@ type ResourceManager interface {
 	Resource() spec.ResourceName
 	Devices() Devices
 	GetPreferredAllocation(available, required []string, size int) ([]string, error)
-	CheckHealth(stop <-chan interface{}, unhealthy chan<- *Device) error
+	ExplainPreferredAllocation(available, required []string, size int) ([]string, *AllocationDecision, error)
+	CheckHealth(stop <-chan interface{}, unhealthy chan<- *Device, healthy chan<- *Device) error
 }
 
+// TopologyFunc returns the devices with the given UUIDs together with the links between them
+type TopologyFunc func(uuids []string) ([]*gpuallocator.Device, error)
+
 // NewResourceManagers returns a []ResourceManager, one for each resource in 'config'.
 func NewResourceManagers(config *spec.Config) ([]ResourceManager, error) {
 	nvml.Init()
 	defer nvml.Shutdown()
 
-	deviceMap, err := buildDeviceMap(config)
+	caps, err := detectCapabilities()
+	if err != nil {
+		return nil, fmt.Errorf("error detecting driver capabilities: %v", err)
+	}
+	log.Printf("Detected driver capabilities: %v", caps)
+
+	deviceMap, err := buildDeviceMap(config, caps)
 	if err != nil {
 		return nil, fmt.Errorf("error building device map: %v", err)
 	}
@@ -56,6 +74,39 @@ func NewResourceManagers(config *spec.Config) ([]ResourceManager, error) {
 			config:   config,
 			resource: resourceName,
 			devices:  devices,
+			caps:     caps,
+		}
+		if len(r.Devices()) != 0 {
+			rms = append(rms, r)
+		}
+	}
+
+	return rms, nil
+}
+
+// NewSimulatedResourceManagers returns a []ResourceManager, one for each resource in 'deviceMap'.
+// The devices are not backed by NVML (e.g. they are simulated for testing), so the links between them are
+// provided by 'topology' and no health checks are performed on them. Replicas are added as set in 'config'.
+func NewSimulatedResourceManagers(config *spec.Config, deviceMap map[spec.ResourceName]Devices, topology TopologyFunc) ([]ResourceManager, error) {
+	deviceMap, err := updateDeviceMapWithReplicas(config, deviceMap)
+	if err != nil {
+		return nil, fmt.Errorf("error updating device map with replicas from config.sharing: %v", err)
+	}
+
+	caps := &capabilities{
+		topology: topology != nil,
+		mig:      true,
+	}
+
+	var rms []ResourceManager
+	for resourceName, devices := range deviceMap {
+		r := &resourceManager{
+			config:    config,
+			resource:  resourceName,
+			devices:   devices,
+			caps:      caps,
+			topology:  topology,
+			simulated: true,
 		}
 		if len(r.Devices()) != 0 {
 			rms = append(rms, r)
@@ -76,13 +127,24 @@ func (r *resourceManager) Devices() Devices {
 }
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
-func (r *resourceManager) CheckHealth(stop <-chan interface{}, unhealthy chan<- *Device) error {
-	return r.checkHealth(stop, r.devices, unhealthy)
+// and to the 'healthy' channel with any previously unhealthy devices that have recovered
+func (r *resourceManager) CheckHealth(stop <-chan interface{}, unhealthy chan<- *Device, healthy chan<- *Device) error {
+	if r.simulated {
+		return nil
+	}
+	return r.checkHealth(stop, r.devices, unhealthy, healthy)
 }
 
 // GetPreferredAllocation runs an allocation algorithm over the inputs.
 // The algorithm chosen is based both on the incoming set of available devices and various config settings.
 func (r *resourceManager) GetPreferredAllocation(available, required []string, size int) ([]string, error) {
+	devices, _, err := r.getPreferredAllocation(available, required, size)
+	return devices, err
+}
+
+// ExplainPreferredAllocation runs the same allocation algorithm as GetPreferredAllocation.
+// It also returns an AllocationDecision explaining how the allocation was calculated.
+func (r *resourceManager) ExplainPreferredAllocation(available, required []string, size int) ([]string, *AllocationDecision, error) {
 	return r.getPreferredAllocation(available, required, size)
 }
 